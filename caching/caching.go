@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/cloudfoundry-community/go-cfclient"
@@ -17,124 +18,297 @@ type AppInfo struct {
 	SpaceID string `json:"spaceId"`
 }
 
+type CacheConfig struct {
+	// TTL is how often all apps are reloaded in the background, and how long
+	// app infos are used before they are looked up again. Reloaded app infos
+	// are used for twice as long, so that they outlast the next reload. Zero
+	// keeps app infos forever.
+	TTL time.Duration
+	// NegativeTTL is how long a failed lookup, e.g. of a deleted app or of a
+	// system component, is remembered before the app is looked up again.
+	// Zero looks apps up again on every miss.
+	NegativeTTL time.Duration
+	// PageSize is the number of apps loaded per Cloud Controller request,
+	// zero uses DefaultPageSize.
+	PageSize int
+}
+
+type cacheEntry struct {
+	info AppInfo
+	// zero when the entry never expires
+	expires time.Time
+	// set when the lookup failed, info is then empty or expired
+	failed bool
+}
+
+// lookupCall is a Cloud Controller lookup which concurrent misses of the
+// same app wait for instead of doing their own.
+type lookupCall struct {
+	done    chan struct{}
+	appInfo AppInfo
+}
+
 type Caching struct {
-	cfClientConfig *cfclient.Config
-	appInfosByGuid map[string]AppInfo
+	cacheConfig    CacheConfig
+	appInfosByGuid map[string]cacheEntry
 	appInfoLock    sync.RWMutex
+	lookups        map[string]*lookupCall
+	lookupsLock    sync.Mutex
+	ccClient       *ccClient
 	logger         lager.Logger
 	instanceName   string
 	environment    string
+	// Cloud Controller lookups, replaced in tests. listApps returns the apps
+	// it could load along with an error.
+	listApps  func() (map[string]AppInfo, error)
+	appByGuid func(string) (AppInfo, error)
+	// first delay before retrying a failed page of apps
+	pageRetryDelay time.Duration
+	// closed by Stop to end the background refresh
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 type CachingClient interface {
 	GetAppInfo(string) AppInfo
+	GetCachedAppInfo(string) (AppInfo, bool)
 	GetInstanceName() string
 	GetEnvironmentName() string
 	Initialize()
+	Stop()
 }
 
-func NewCaching(config *cfclient.Config, logger lager.Logger, environment string) CachingClient {
-	return &Caching{
-		cfClientConfig: config,
-		appInfosByGuid: make(map[string]AppInfo),
+func NewCaching(config *cfclient.Config, cacheConfig *CacheConfig, logger lager.Logger, environment string) CachingClient {
+	c := &Caching{
+		cacheConfig:    *cacheConfig,
+		appInfosByGuid: make(map[string]cacheEntry),
+		lookups:        make(map[string]*lookupCall),
+		ccClient:       newCCClient(config),
 		logger:         logger,
 		environment:    environment,
+		pageRetryDelay: defaultPageRetryDelay,
+		stop:           make(chan struct{}),
 	}
+	c.listApps = c.listAppsFromCC
+	c.appByGuid = c.appByGuidFromCC
+	return c
 }
 
 func (c *Caching) Initialize() {
 	c.setInstanceName()
 
-	cfClient, err := cfclient.NewClient(c.cfClientConfig)
+	// apps which failed to load are looked up when their events come in,
+	// and the next refresh loads them again
+	apps, err := c.listApps()
 	if err != nil {
-		c.logger.Fatal("error creating cfclient", err)
+		c.logger.Error("error getting app list", err, lager.Data{"loaded": len(apps)})
+		c.mergeAppInfos(apps)
+	} else {
+		c.replaceAppInfos(apps)
 	}
 
-	apps, err := cfClient.ListApps()
-	if err != nil {
-		c.logger.Fatal("error getting app list", err)
+	c.logger.Debug("Cache initialize completed",
+		lager.Data{"cache size": len(apps)})
+
+	if c.cacheConfig.TTL > 0 {
+		go c.refresh()
 	}
+}
+
+// Stop ends the background refresh, the cached app infos can still be used
+// and looked up.
+func (c *Caching) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
 
-	for _, app := range apps {
-		var appInfo = AppInfo{
-			Name:    app.Name,
-			Org:     app.SpaceData.Entity.OrgData.Entity.Name,
-			OrgID:   app.SpaceData.Entity.OrgData.Entity.Guid,
-			Space:   app.SpaceData.Entity.Name,
-			SpaceID: app.SpaceData.Entity.Guid,
+// refresh reloads all apps every TTL until stopped, so that renamed apps,
+// spaces and orgs are picked up and deleted apps are evicted.
+func (c *Caching) refresh() {
+	ticker := time.NewTicker(c.cacheConfig.TTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+		apps, err := c.listApps()
+		if err != nil {
+			// update the apps which loaded, and keep using the current app
+			// infos of the others until the next refresh
+			c.logger.Error("error refreshing app info cache", err, lager.Data{"loaded": len(apps)})
+			c.mergeAppInfos(apps)
+			continue
 		}
-		c.appInfosByGuid[app.Guid] = appInfo
-		c.logger.Debug("adding to app info cache",
-			lager.Data{"guid": app.Guid},
-			lager.Data{"info": appInfo})
+		evicted := c.replaceAppInfos(apps)
+		c.logger.Debug("app info cache refreshed",
+			lager.Data{"cache size": len(apps), "evicted": evicted})
 	}
+}
 
-	c.logger.Debug("Cache initialize completed",
-		lager.Data{"cache size": len(c.appInfosByGuid)})
+// replaceAppInfos swaps the cache for the given apps and returns how many
+// cached apps are gone. The new cache is built before taking the lock so
+// that readers are only held up by the swap.
+func (c *Caching) replaceAppInfos(apps map[string]AppInfo) int {
+	expires := c.bulkExpiry()
+	appInfosByGuid := make(map[string]cacheEntry, len(apps))
+	for guid, appInfo := range apps {
+		appInfosByGuid[guid] = cacheEntry{info: appInfo, expires: expires}
+	}
+
+	now := time.Now()
+
+	c.appInfoLock.Lock()
+	defer c.appInfoLock.Unlock()
+
+	evicted := 0
+	for guid, entry := range c.appInfosByGuid {
+		if _, ok := appInfosByGuid[guid]; ok {
+			continue
+		}
+		if entry.failed && now.Before(entry.expires) {
+			// keep not looking up unknown apps
+			appInfosByGuid[guid] = entry
+			continue
+		}
+		evicted++
+	}
+	c.appInfosByGuid = appInfosByGuid
+	return evicted
+}
+
+// mergeAppInfos updates the cache with the given apps without evicting the
+// others.
+func (c *Caching) mergeAppInfos(apps map[string]AppInfo) {
+	expires := c.bulkExpiry()
+
+	c.appInfoLock.Lock()
+	defer c.appInfoLock.Unlock()
+
+	for guid, appInfo := range apps {
+		c.appInfosByGuid[guid] = cacheEntry{info: appInfo, expires: expires}
+	}
+}
+
+func (c *Caching) expiry() time.Time {
+	if c.cacheConfig.TTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.cacheConfig.TTL)
+}
+
+// bulkExpiry is the expiry of app infos loaded by the background refresh.
+// They outlive the refresh interval, so that they are still fresh while the
+// next refresh loads all apps again.
+func (c *Caching) bulkExpiry() time.Time {
+	if c.cacheConfig.TTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(2 * c.cacheConfig.TTL)
 }
 
 func (c *Caching) GetAppInfo(appGuid string) AppInfo {
-	var appInfo AppInfo
+	var entry cacheEntry
 	var ok bool
 	func() {
 		c.appInfoLock.RLock()
 		defer c.appInfoLock.RUnlock()
-		appInfo, ok = c.appInfosByGuid[appGuid]
+		entry, ok = c.appInfosByGuid[appGuid]
 	}()
-	if ok {
-		return appInfo
-	} else {
-		c.logger.Debug("App info not found for GUID",
-			lager.Data{"guid": appGuid})
-		// call the client api to get the name for this app
-		// purposely create a new client due to issue in using a single client
-		cachingCFClientConfig := &cfclient.Config{
-			ApiAddress:        c.cfClientConfig.ApiAddress,
-			Username:          c.cfClientConfig.Username,
-			Password:          c.cfClientConfig.Password,
-			SkipSslValidation: c.cfClientConfig.SkipSslValidation,
-		}
-		cfClient, err := cfclient.NewClient(cachingCFClientConfig)
-		if err != nil {
-			c.logger.Error("error creating cfclient", err)
-			return AppInfo{
-				Name:    "",
-				Org:     "",
-				OrgID:   "",
-				Space:   "",
-				SpaceID: "",
-			}
-		}
-		app, err := cfClient.AppByGuid(appGuid)
-		if err != nil {
-			c.logger.Error("error getting app info", err, lager.Data{"guid": appGuid})
-			return AppInfo{
-				Name:    "",
-				Org:     "",
-				OrgID:   "",
-				Space:   "",
-				SpaceID: "",
-			}
+	if ok && (entry.expires.IsZero() || time.Now().Before(entry.expires)) {
+		return entry.info
+	}
+
+	c.logger.Debug("App info not found for GUID",
+		lager.Data{"guid": appGuid, "expired": ok})
+	return c.lookup(appGuid, entry.info)
+}
+
+// GetCachedAppInfo returns the cached app info, which may be expired or empty,
+// without looking the app up. It reports whether the app info is fresh.
+func (c *Caching) GetCachedAppInfo(appGuid string) (AppInfo, bool) {
+	c.appInfoLock.RLock()
+	defer c.appInfoLock.RUnlock()
+	entry, ok := c.appInfosByGuid[appGuid]
+	return entry.info, ok && (entry.expires.IsZero() || time.Now().Before(entry.expires))
+}
+
+// lookup gets the app info from the Cloud Controller and caches it. Only one
+// lookup per app is in flight, concurrent misses wait for its result.
+func (c *Caching) lookup(appGuid string, expired AppInfo) AppInfo {
+	c.lookupsLock.Lock()
+	if call, ok := c.lookups[appGuid]; ok {
+		c.lookupsLock.Unlock()
+		<-call.done
+		return call.appInfo
+	}
+	call := &lookupCall{done: make(chan struct{})}
+	c.lookups[appGuid] = call
+	c.lookupsLock.Unlock()
+
+	defer func() {
+		c.lookupsLock.Lock()
+		delete(c.lookups, appGuid)
+		c.lookupsLock.Unlock()
+		close(call.done)
+	}()
+
+	appInfo, err := c.appByGuid(appGuid)
+	if err != nil {
+		if cfclient.IsAppNotFoundError(err) {
+			c.logger.Debug("app not found", lager.Data{"guid": appGuid})
 		} else {
-			// store app info in map
-			appInfo = AppInfo{
-				Name:    app.Name,
-				Org:     app.SpaceData.Entity.OrgData.Entity.Name,
-				OrgID:   app.SpaceData.Entity.OrgData.Entity.Guid,
-				Space:   app.SpaceData.Entity.Name,
-				SpaceID: app.SpaceData.Entity.Guid,
-			}
-			func() {
-				c.appInfoLock.Lock()
-				defer c.appInfoLock.Unlock()
-				c.appInfosByGuid[app.Guid] = appInfo
-			}()
-			c.logger.Debug("adding to app info cache",
-				lager.Data{"guid": app.Guid},
-				lager.Data{"info": appInfo})
-			// return the app name
-			return appInfo
+			c.logger.Error("error getting app info", err, lager.Data{"guid": appGuid})
+		}
+		// an expired app info is better than none
+		call.appInfo = expired
+		if c.cacheConfig.NegativeTTL > 0 {
+			c.storeAppInfo(appGuid, cacheEntry{
+				info:    expired,
+				expires: time.Now().Add(c.cacheConfig.NegativeTTL),
+				failed:  true,
+			})
 		}
+		return call.appInfo
+	}
+
+	call.appInfo = appInfo
+	c.storeAppInfo(appGuid, cacheEntry{info: appInfo, expires: c.expiry()})
+	c.logger.Debug("adding to app info cache",
+		lager.Data{"guid": appGuid},
+		lager.Data{"info": appInfo})
+	return appInfo
+}
+
+func (c *Caching) storeAppInfo(appGuid string, entry cacheEntry) {
+	c.appInfoLock.Lock()
+	defer c.appInfoLock.Unlock()
+	c.appInfosByGuid[appGuid] = entry
+}
+
+func (c *Caching) appByGuidFromCC(appGuid string) (AppInfo, error) {
+	var app cfclient.App
+	err := c.ccClient.do(func(client *cfclient.Client) error {
+		var err error
+		app, err = client.AppByGuid(appGuid)
+		return err
+	})
+	if err != nil {
+		return AppInfo{}, err
+	}
+	return newAppInfo(app), nil
+}
+
+func newAppInfo(app cfclient.App) AppInfo {
+	return AppInfo{
+		Name:    app.Name,
+		Org:     app.SpaceData.Entity.OrgData.Entity.Name,
+		OrgID:   app.SpaceData.Entity.OrgData.Entity.Guid,
+		Space:   app.SpaceData.Entity.Name,
+		SpaceID: app.SpaceData.Entity.Guid,
 	}
 }
 
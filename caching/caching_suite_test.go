@@ -0,0 +1,13 @@
+package caching_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCaching(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "App info cache Suite")
+}
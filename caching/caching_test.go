@@ -0,0 +1,199 @@
+package caching_test
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/humio/cloudfoundry2humio/caching"
+	"github.com/humio/cloudfoundry2humio/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("App info cache", func() {
+	var (
+		lock       sync.Mutex
+		apps       map[string]caching.AppInfo
+		listErr    error
+		lookups    []string
+		listApps   func() (map[string]caching.AppInfo, error)
+		appByGuid  func(string) (caching.AppInfo, error)
+		release    chan struct{}
+		listing    chan struct{}
+		newCaching func(config *caching.CacheConfig) caching.CachingClient
+		cachings   []caching.CachingClient
+	)
+
+	setApps := func(a map[string]caching.AppInfo, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		apps, listErr = a, err
+	}
+
+	BeforeEach(func() {
+		// a refresh of an earlier spec may still be loading the apps
+		lock.Lock()
+		lookups = nil
+		release = nil
+		listing = nil
+		lock.Unlock()
+		setApps(map[string]caching.AppInfo{"app-1": {Name: "one"}}, nil)
+
+		listApps = func() (map[string]caching.AppInfo, error) {
+			lock.Lock()
+			wait := listing
+			lock.Unlock()
+			if wait != nil {
+				<-wait
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			copied := make(map[string]caching.AppInfo, len(apps))
+			for guid, appInfo := range apps {
+				copied[guid] = appInfo
+			}
+			return copied, listErr
+		}
+		appByGuid = func(guid string) (caching.AppInfo, error) {
+			if release != nil {
+				<-release
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			lookups = append(lookups, guid)
+			if appInfo, ok := apps[guid]; ok {
+				return appInfo, nil
+			}
+			return caching.AppInfo{}, errors.New("app not found")
+		}
+		newCaching = func(config *caching.CacheConfig) caching.CachingClient {
+			c := caching.NewCachingWithLookups(listApps, appByGuid, config, mocks.NewMockLogger())
+			c.Initialize()
+			cachings = append(cachings, c)
+			return c
+		}
+	})
+
+	AfterEach(func() {
+		for _, c := range cachings {
+			c.Stop()
+		}
+		cachings = nil
+	})
+
+	getLookups := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return lookups
+	}
+
+	It("loads all apps on start", func() {
+		c := newCaching(&caching.CacheConfig{})
+
+		Expect(c.GetAppInfo("app-1").Name).To(Equal("one"))
+		Expect(getLookups()).To(BeEmpty())
+	})
+
+	It("looks up and caches apps it doesn't know", func() {
+		c := newCaching(&caching.CacheConfig{})
+		setApps(map[string]caching.AppInfo{"app-2": {Name: "two"}}, nil)
+
+		Expect(c.GetAppInfo("app-2").Name).To(Equal("two"))
+		Expect(c.GetAppInfo("app-2").Name).To(Equal("two"))
+		Expect(getLookups()).To(Equal([]string{"app-2"}))
+	})
+
+	It("refreshes renamed apps and evicts deleted apps", func() {
+		c := newCaching(&caching.CacheConfig{TTL: 20 * time.Millisecond})
+		setApps(map[string]caching.AppInfo{"app-1": {Name: "renamed"}}, nil)
+
+		Eventually(func() string { return c.GetAppInfo("app-1").Name }).Should(Equal("renamed"))
+
+		setApps(map[string]caching.AppInfo{}, nil)
+		Eventually(func() string { return c.GetAppInfo("app-1").Name }).Should(BeEmpty())
+	})
+
+	It("stops refreshing once stopped", func() {
+		c := newCaching(&caching.CacheConfig{TTL: 20 * time.Millisecond})
+		c.Stop()
+		setApps(map[string]caching.AppInfo{"app-1": {Name: "renamed"}}, nil)
+
+		Consistently(func() string {
+			appInfo, _ := c.GetCachedAppInfo("app-1")
+			return appInfo.Name
+		}, 100*time.Millisecond).Should(Equal("one"))
+	})
+
+	It("keeps app infos fresh while a refresh is loading the apps", func() {
+		c := newCaching(&caching.CacheConfig{TTL: 50 * time.Millisecond})
+		lock.Lock()
+		listing = make(chan struct{})
+		lock.Unlock()
+		defer close(listing)
+
+		Consistently(func() bool {
+			_, fresh := c.GetCachedAppInfo("app-1")
+			return fresh
+		}, 80*time.Millisecond).Should(BeTrue())
+	})
+
+	It("keeps expired app infos when the Cloud Controller fails", func() {
+		c := newCaching(&caching.CacheConfig{TTL: 20 * time.Millisecond})
+		setApps(nil, errors.New("unavailable"))
+
+		Consistently(func() string { return c.GetAppInfo("app-1").Name }, 100*time.Millisecond).Should(Equal("one"))
+	})
+
+	It("starts with the apps it loaded when the Cloud Controller fails", func() {
+		setApps(map[string]caching.AppInfo{"app-1": {Name: "one"}}, errors.New("page 2 failed"))
+		c := newCaching(&caching.CacheConfig{})
+
+		Expect(c.GetAppInfo("app-1").Name).To(Equal("one"))
+		Expect(getLookups()).To(BeEmpty())
+	})
+
+	It("updates the apps it loaded without evicting the others when a refresh fails", func() {
+		setApps(map[string]caching.AppInfo{"app-1": {Name: "one"}, "app-2": {Name: "two"}}, nil)
+		c := newCaching(&caching.CacheConfig{TTL: 20 * time.Millisecond})
+		setApps(map[string]caching.AppInfo{"app-1": {Name: "renamed"}}, errors.New("page 2 failed"))
+
+		Eventually(func() string { return c.GetAppInfo("app-1").Name }).Should(Equal("renamed"))
+		Expect(c.GetAppInfo("app-2").Name).To(Equal("two"))
+	})
+
+	It("remembers apps it failed to look up", func() {
+		c := newCaching(&caching.CacheConfig{NegativeTTL: 50 * time.Millisecond})
+
+		Expect(c.GetAppInfo("system")).To(Equal(caching.AppInfo{}))
+		Expect(c.GetAppInfo("system")).To(Equal(caching.AppInfo{}))
+		Expect(getLookups()).To(Equal([]string{"system"}))
+
+		Eventually(func() []string {
+			c.GetAppInfo("system")
+			return getLookups()
+		}).Should(HaveLen(2))
+	})
+
+	It("looks up an app once for concurrent misses", func() {
+		c := newCaching(&caching.CacheConfig{})
+		setApps(map[string]caching.AppInfo{"app-2": {Name: "two"}}, nil)
+		release = make(chan struct{})
+
+		results := make(chan string, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				results <- c.GetAppInfo("app-2").Name
+			}()
+		}
+		// give the other misses time to wait for the first lookup
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+
+		for i := 0; i < 3; i++ {
+			Eventually(results).Should(Receive(Equal("two")))
+		}
+		Expect(getLookups()).To(Equal([]string{"app-2"}))
+	})
+})
@@ -0,0 +1,84 @@
+package caching
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+// ccClient shares a single logged in cfclient between Cloud Controller
+// lookups. The cfclient refreshes its access token by itself; once that fails,
+// e.g. because the refresh token expired too, ccClient logs in again.
+type ccClient struct {
+	config *cfclient.Config
+	lock   sync.Mutex
+	client *cfclient.Client
+}
+
+func newCCClient(config *cfclient.Config) *ccClient {
+	return &ccClient{config: config}
+}
+
+// do calls f with the shared client, logging in again and retrying once when
+// f fails to authenticate.
+func (c *ccClient) do(f func(*cfclient.Client) error) error {
+	client, err := c.get()
+	if err != nil {
+		return err
+	}
+
+	err = f(client)
+	if !isAuthError(err) {
+		return err
+	}
+
+	c.reset(client)
+	client, err = c.get()
+	if err != nil {
+		return err
+	}
+	return f(client)
+}
+
+func (c *ccClient) get() (*cfclient.Client, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	// cfclient.NewClient fills in the config it's given, so give it a copy
+	client, err := cfclient.NewClient(&cfclient.Config{
+		ApiAddress:        c.config.ApiAddress,
+		Username:          c.config.Username,
+		Password:          c.config.Password,
+		SkipSslValidation: c.config.SkipSslValidation,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.client = client
+	return client, nil
+}
+
+// reset drops the client unless another lookup replaced it already.
+func (c *ccClient) reset(client *cfclient.Client) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.client == client {
+		c.client = nil
+	}
+}
+
+func isAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// token refresh failures are only reported as oauth2 error messages
+	return cfclient.IsNotAuthenticatedError(err) ||
+		cfclient.IsInvalidAuthTokenError(err) ||
+		strings.Contains(err.Error(), "oauth2:")
+}
@@ -0,0 +1,162 @@
+package caching
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+const (
+	// DefaultPageSize is the number of apps per Cloud Controller page, the v3
+	// API allows up to 5000.
+	DefaultPageSize = 1000
+	maxPageSize     = 5000
+	// a failing page is tried pageAttempts times, waiting
+	// defaultPageRetryDelay before the first retry and twice as long after
+	// each further failure
+	pageAttempts          = 4
+	defaultPageRetryDelay = time.Second
+)
+
+// v3Relationship is the to-one relationship of a v3 resource.
+type v3Relationship struct {
+	Data struct {
+		Guid string `json:"guid"`
+	} `json:"data"`
+}
+
+type v3Resource struct {
+	Guid          string                    `json:"guid"`
+	Name          string                    `json:"name"`
+	Relationships map[string]v3Relationship `json:"relationships"`
+}
+
+// v3AppsPage is a page of /v3/apps with the spaces and orgs of its apps
+// included.
+type v3AppsPage struct {
+	Pagination struct {
+		TotalResults int `json:"total_results"`
+		TotalPages   int `json:"total_pages"`
+	} `json:"pagination"`
+	Resources []v3Resource `json:"resources"`
+	Included  struct {
+		Spaces        []v3Resource `json:"spaces"`
+		Organizations []v3Resource `json:"organizations"`
+	} `json:"included"`
+}
+
+// appsPath is a page of all apps with their spaces and orgs.
+func appsPath(pageSize int, page int) string {
+	if pageSize < 1 || pageSize > maxPageSize {
+		pageSize = DefaultPageSize
+	}
+	q := url.Values{}
+	q.Set("include", "space.organization")
+	q.Set("per_page", fmt.Sprint(pageSize))
+	q.Set("page", fmt.Sprint(page))
+	q.Set("order_by", "created_at")
+	return "/v3/apps?" + q.Encode()
+}
+
+// listAppsFromCC loads all apps page by page from the v3 API, which includes
+// the spaces and orgs of each page instead of looking them up per app. Pages
+// which keep failing are skipped, the apps of the other pages are returned
+// with an error.
+func (c *Caching) listAppsFromCC() (map[string]AppInfo, error) {
+	start := time.Now()
+	appInfos := make(map[string]AppInfo)
+
+	var failed []int
+	totalPages, totalApps := 1, 0
+	for page := 1; page <= totalPages; page++ {
+		p, err := c.appsPage(page)
+		if err != nil {
+			if page == 1 {
+				// the number of pages isn't known
+				return appInfos, fmt.Errorf("error getting apps page 1: %s", err)
+			}
+			c.logger.Error("skipping apps page", err, lager.Data{"page": page, "total pages": totalPages})
+			failed = append(failed, page)
+			continue
+		}
+		totalPages, totalApps = p.Pagination.TotalPages, p.Pagination.TotalResults
+
+		addAppInfos(appInfos, p)
+		c.logger.Info("loaded apps page", lager.Data{
+			"page":        page,
+			"total pages": totalPages,
+			"apps":        len(appInfos),
+			"total apps":  totalApps,
+		})
+	}
+
+	if len(failed) > 0 {
+		return appInfos, fmt.Errorf("error getting apps pages %v, loaded %d of %d apps", failed, len(appInfos), totalApps)
+	}
+	c.logger.Info("loaded all apps", lager.Data{"apps": len(appInfos), "duration": time.Since(start).String()})
+	return appInfos, nil
+}
+
+// appsPage gets a page of apps, retrying with backoff when it fails.
+func (c *Caching) appsPage(page int) (v3AppsPage, error) {
+	path := appsPath(c.cacheConfig.PageSize, page)
+	delay := c.pageRetryDelay
+
+	var p v3AppsPage
+	for attempt := 1; ; attempt++ {
+		err := c.ccClient.do(func(client *cfclient.Client) error {
+			var err error
+			p, err = getAppsPage(client, path)
+			return err
+		})
+		if err == nil || attempt == pageAttempts {
+			return p, err
+		}
+		c.logger.Error("failed getting apps page, retrying", err, lager.Data{"page": page, "attempt": attempt, "delay": delay.String()})
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func getAppsPage(client *cfclient.Client, path string) (v3AppsPage, error) {
+	var p v3AppsPage
+	resp, err := client.DoRequest(client.NewRequest("GET", path))
+	if err != nil {
+		return p, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return p, fmt.Errorf("error decoding apps page: %s", err)
+	}
+	return p, nil
+}
+
+// addAppInfos adds the apps of the page with the names of their space and
+// org, which are left empty when the page doesn't include them.
+func addAppInfos(appInfos map[string]AppInfo, p v3AppsPage) {
+	orgs := make(map[string]string, len(p.Included.Organizations))
+	for _, org := range p.Included.Organizations {
+		orgs[org.Guid] = org.Name
+	}
+	spaces := make(map[string]v3Resource, len(p.Included.Spaces))
+	for _, space := range p.Included.Spaces {
+		spaces[space.Guid] = space
+	}
+
+	for _, app := range p.Resources {
+		spaceID := app.Relationships["space"].Data.Guid
+		space := spaces[spaceID]
+		orgID := space.Relationships["organization"].Data.Guid
+		appInfos[app.Guid] = AppInfo{
+			Name:    app.Name,
+			Org:     orgs[orgID],
+			OrgID:   orgID,
+			Space:   space.Name,
+			SpaceID: spaceID,
+		}
+	}
+}
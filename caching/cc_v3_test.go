@@ -0,0 +1,113 @@
+package caching_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/humio/cloudfoundry2humio/caching"
+	"github.com/humio/cloudfoundry2humio/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cloud Controller v3 app loader", func() {
+	var (
+		server   *httptest.Server
+		lock     sync.Mutex
+		requests []string
+		pages    map[string]string
+		failures map[string]int
+	)
+
+	page := func(apps string, spaces string) string {
+		return `{
+			"pagination": {"total_results": 3, "total_pages": 3},
+			"resources": [` + apps + `],
+			"included": {
+				"spaces": [` + spaces + `],
+				"organizations": [{"guid": "org-1", "name": "team"}]
+			}
+		}`
+	}
+
+	BeforeEach(func() {
+		requests = nil
+		failures = map[string]int{}
+		dev := `{"guid": "space-1", "name": "dev", "relationships": {"organization": {"data": {"guid": "org-1"}}}}`
+		prod := `{"guid": "space-2", "name": "prod", "relationships": {"organization": {"data": {"guid": "org-1"}}}}`
+		pages = map[string]string{
+			"1": page(`{"guid": "app-1", "name": "one", "relationships": {"space": {"data": {"guid": "space-1"}}}}`, dev),
+			"2": page(`{"guid": "app-2", "name": "two", "relationships": {"space": {"data": {"guid": "space-2"}}}}`, prod),
+			"3": page(`{"guid": "app-3", "name": "three", "relationships": {"space": {"data": {"guid": "space-1"}}}}`, dev),
+		}
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := r.URL.Query().Get("page")
+			lock.Lock()
+			requests = append(requests, r.URL.RequestURI())
+			fail := failures[n] != 0
+			if failures[n] > 0 {
+				failures[n]--
+			}
+			lock.Unlock()
+
+			if fail {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprint(w, `{"errors":[{"code":10015,"title":"CF-ServiceUnavailable"}]}`)
+				return
+			}
+			fmt.Fprint(w, pages[n])
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("loads all pages of apps with their spaces and orgs", func() {
+		apps, err := caching.ListAppsFromCC(server.URL, 1, mocks.NewMockLogger())
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(HaveLen(3))
+		Expect(requests[0]).To(ContainSubstring("include=space.organization"))
+		Expect(requests[0]).To(ContainSubstring("per_page=1"))
+		Expect(apps).To(Equal(map[string]caching.AppInfo{
+			"app-1": {Name: "one", Org: "team", OrgID: "org-1", Space: "dev", SpaceID: "space-1"},
+			"app-2": {Name: "two", Org: "team", OrgID: "org-1", Space: "prod", SpaceID: "space-2"},
+			"app-3": {Name: "three", Org: "team", OrgID: "org-1", Space: "dev", SpaceID: "space-1"},
+		}))
+	})
+
+	It("retries a failing page", func() {
+		failures["2"] = 2
+
+		apps, err := caching.ListAppsFromCC(server.URL, 1, mocks.NewMockLogger())
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(apps).To(HaveLen(3))
+		Expect(requests).To(HaveLen(5))
+	})
+
+	It("skips a page which keeps failing and loads the others", func() {
+		failures["2"] = -1
+
+		apps, err := caching.ListAppsFromCC(server.URL, 1, mocks.NewMockLogger())
+
+		Expect(err).To(HaveOccurred())
+		Expect(apps).To(HaveLen(2))
+		Expect(apps).To(HaveKey("app-1"))
+		Expect(apps).To(HaveKey("app-3"))
+	})
+
+	It("gives up when the first page keeps failing", func() {
+		failures["1"] = -1
+
+		apps, err := caching.ListAppsFromCC(server.URL, 1, mocks.NewMockLogger())
+
+		Expect(err).To(HaveOccurred())
+		Expect(apps).To(BeEmpty())
+		Expect(requests).To(HaveLen(4))
+	})
+})
@@ -0,0 +1,28 @@
+package caching
+
+import (
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+func NewCachingWithLookups(listApps func() (map[string]AppInfo, error), appByGuid func(string) (AppInfo, error), cacheConfig *CacheConfig, logger lager.Logger) CachingClient {
+	c := NewCaching(&cfclient.Config{}, cacheConfig, logger, "test").(*Caching)
+	c.listApps = listApps
+	c.appByGuid = appByGuid
+	return c
+}
+
+// ListAppsFromCC loads all apps from a Cloud Controller which doesn't
+// require a login.
+func ListAppsFromCC(apiAddress string, pageSize int, logger lager.Logger) (map[string]AppInfo, error) {
+	c := NewCaching(&cfclient.Config{}, &CacheConfig{PageSize: pageSize}, logger, "test").(*Caching)
+	c.ccClient.client = &cfclient.Client{Config: cfclient.Config{
+		ApiAddress: apiAddress,
+		HttpClient: http.DefaultClient,
+	}}
+	c.pageRetryDelay = time.Millisecond
+	return c.listAppsFromCC()
+}
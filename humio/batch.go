@@ -0,0 +1,41 @@
+package humio
+
+// Batch groups events by their tags so that a whole batch can be posted to
+// Humio as a single ingest request.
+type Batch struct {
+	groups []Events
+	index  map[string]int
+	size   int
+}
+
+func NewBatch() *Batch {
+	return &Batch{
+		index: make(map[string]int),
+	}
+}
+
+// Add appends the event to the group of events sharing the same tags.
+func (b *Batch) Add(tags Tags, event Event) {
+	if tags == nil {
+		tags = Tags{}
+	}
+	key := tags.key()
+	i, ok := b.index[key]
+	if !ok {
+		i = len(b.groups)
+		b.index[key] = i
+		b.groups = append(b.groups, Events{Tags: tags})
+	}
+	b.groups[i].Events = append(b.groups[i].Events, event)
+	b.size++
+}
+
+// Len returns the number of events in the batch.
+func (b *Batch) Len() int {
+	return b.size
+}
+
+// Groups returns the ingest payload of the batch.
+func (b *Batch) Groups() []Events {
+	return b.groups
+}
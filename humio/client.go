@@ -1,73 +1,249 @@
 package humio
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"code.cloudfoundry.org/lager"
-	"github.com/parnurzeal/gorequest"
 )
 
 type HumioClient interface {
-	PushEvents(*Events) error
-	SingleLog(string) error
+	PushEvents(context.Context, []Events) error
+	SingleLog(context.Context, string) error
 }
 
 type client struct {
-	config          HumioConfig
-	httpPostTimeout time.Duration
-	logger          lager.Logger
+	config     HumioConfig
+	httpClient *http.Client
+	logger     lager.Logger
+	// set once Humio rejected a gzip payload
+	gzipRejected int32
 }
 
 type HumioConfig struct {
 	Host      string
 	Dataspace string
 	Token     string
+	// retry policy for 429, 5xx and transport errors
+	MaxRetries    int
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+	// transport tuning, zero values fall back to the defaults below
+	RequestTimeout        time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	// gzip request bodies, GzipLevel is one of the compress/gzip levels
+	Gzip      bool
+	GzipLevel int
+	// one of the Ingest* protocols, empty means IngestLegacy
+	Protocol string
+	// parser applied by Humio to lines sent with IngestUnstructured
+	Parser string
 }
 
+const (
+	defaultRequestTimeout  = 10 * time.Second
+	defaultIdleConnTimeout = 90 * time.Second
+	defaultMaxIdleConns    = 16
+)
+
 func NewHumioClient(humioConfig *HumioConfig, logger lager.Logger) HumioClient {
 	return &client{
-		config:          *humioConfig,
-		httpPostTimeout: 10,
-		logger:          logger,
+		config:     *humioConfig,
+		httpClient: newHTTPClient(humioConfig),
+		logger:     logger,
 	}
 }
 
-func (c *client) PushEvents(events *Events) error {
-	url := c.config.Host + "/api/v1/dataspaces/" + c.config.Dataspace + "/ingest"
-	request := gorequest.New() // .Timeout(2*time.Millisecond)
-	resp, body, errs := request.Post(url).
-		Set("Authorization", "Bearer "+c.config.Token).
-		Send([]Events{*events}).
-		End()
+// newHTTPClient builds a client that keeps connections to Humio alive and
+// pooled across requests, and negotiates HTTP/2 when Humio offers it.
+func newHTTPClient(config *HumioConfig) *http.Client {
+	requestTimeout := config.RequestTimeout
+	if requestTimeout <= 0 {
+		requestTimeout = defaultRequestTimeout
+	}
+	idleConnTimeout := config.IdleConnTimeout
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = defaultIdleConnTimeout
+	}
+	maxIdleConns := config.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
 
-	if errs != nil {
-		c.logger.Fatal("failed pushing events to Humio", errs[0])
-		return errs[0]
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		IdleConnTimeout:       idleConnTimeout,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConns,
+		ForceAttemptHTTP2:     true,
 	}
 
-	if resp.StatusCode != 200 {
-		c.logger.Error("Humio returned an unexpected response: "+body, nil)
+	return &http.Client{
+		Transport: transport,
+		Timeout:   requestTimeout,
 	}
+}
 
-	return nil
+// PushEvents posts all groups of events in a single ingest request.
+func (c *client) PushEvents(ctx context.Context, events []Events) error {
+	payload, err := c.encode(events)
+	if err != nil {
+		return err
+	}
+	return c.postWithRetry(ctx, payload)
+}
+
+func (c *client) SingleLog(ctx context.Context, log string) error {
+	switch c.config.Protocol {
+	case IngestUnstructured, IngestHEC:
+		return c.PushEvents(ctx, []Events{{
+			Events: []Event{{
+				Timestamp: Timestamp(time.Now().Format(time.RFC3339Nano)),
+				Attributes: Attributes{
+					EventType: "LogMessage",
+					Job:       "nozzle",
+					Log:       LogAttribute{Message: log},
+				},
+			}},
+		}})
+	}
+
+	payload, err := json.Marshal([]map[string]interface{}{{
+		"tags": map[string]string{"source": "humio-nozzle", "job": "nozzle"},
+		"events": []map[string]interface{}{{
+			"attributes": map[string]string{"log": log},
+			"timestamp":  time.Now().Format(time.RFC3339Nano),
+		}},
+	}})
+	if err != nil {
+		return err
+	}
+	return c.postWithRetry(ctx, payload)
+}
+
+func (c *client) postWithRetry(ctx context.Context, payload []byte) error {
+	gzipped := c.compress(payload)
+
+	for attempt := 1; ; attempt++ {
+		err := c.send(ctx, payload, gzipped)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil || !isRetryable(err) || attempt > c.config.MaxRetries {
+			return err
+		}
+
+		delay := c.retryDelay(attempt, err)
+		c.logger.Info("retrying Humio ingest request", lager.Data{
+			"attempt": attempt,
+			"delay":   delay.String(),
+			"error":   err.Error(),
+		})
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// compress returns the gzipped payload, or nil when compression is disabled
+// or failed.
+func (c *client) compress(payload []byte) []byte {
+	if !c.config.Gzip || atomic.LoadInt32(&c.gzipRejected) == 1 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.config.GzipLevel)
+	if err == nil {
+		_, err = w.Write(payload)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		c.logger.Error("failed compressing Humio payload", err)
+		return nil
+	}
+	return buf.Bytes()
 }
 
-func (c *client) SingleLog(log string) error {
-	url := c.config.Host + "/api/v1/dataspaces/" + c.config.Dataspace + "/ingest"
-	request := gorequest.New()
-	resp, body, errs := request.Post(url).
-		Set("Authorization", "Bearer "+c.config.Token).
-		Send(`[{"tags": {"source": "humio-nozzle", "job": "nozzle"}, "events": [{"attributes": {"log": "` + log + `"}, "timestamp": "` + time.Now().Format(time.RFC3339) + `"}]}]`).
-		End()
+// send posts the gzipped payload when there is one, falling back to the
+// uncompressed payload for good if Humio doesn't accept gzip.
+func (c *client) send(ctx context.Context, payload []byte, gzipped []byte) error {
+	if gzipped != nil && atomic.LoadInt32(&c.gzipRejected) == 0 {
+		err := c.post(ctx, gzipped, true)
+		if !isEncodingRejected(err) {
+			return err
+		}
+		if atomic.CompareAndSwapInt32(&c.gzipRejected, 0, 1) {
+			c.logger.Error("Humio rejected a gzip payload, sending uncompressed from now on", err)
+		}
+	}
+	return c.post(ctx, payload, false)
+}
+
+// isEncodingRejected reports whether Humio refused the gzip encoding rather
+// than the payload, which a 400 on its own doesn't tell.
+func isEncodingRejected(err error) bool {
+	ingestErr, ok := err.(*IngestError)
+	if !ok {
+		return false
+	}
+	switch ingestErr.StatusCode {
+	case http.StatusUnsupportedMediaType:
+		return true
+	case http.StatusBadRequest:
+		body := strings.ToLower(ingestErr.Body)
+		return strings.Contains(body, "encoding") || strings.Contains(body, "gzip")
+	}
+	return false
+}
+
+func (c *client) post(ctx context.Context, payload []byte, gzipped bool) error {
+	req, err := http.NewRequest("POST", c.ingestURL(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
 
-	if errs != nil {
-		c.logger.Fatal("failed sending single log event to Humio", errs[0])
-		return errs[0]
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		c.logger.Error("Humio returned an unexpected response: "+body, nil)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return newIngestError(resp, string(body))
 	}
 
+	// drain the body so the connection goes back to the pool
+	io.Copy(ioutil.Discard, resp.Body)
 	return nil
 }
@@ -0,0 +1,199 @@
+package humio_test
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/humio/cloudfoundry2humio/humio"
+	"github.com/humio/cloudfoundry2humio/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Humio client", func() {
+	var (
+		server    *httptest.Server
+		responses []int
+		requests  int
+		encodings []string
+		bodies    []string
+		paths     []string
+		lock      sync.Mutex
+		client    humio.HumioClient
+	)
+
+	BeforeEach(func() {
+		requests = 0
+		encodings = nil
+		bodies = nil
+		paths = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body io.Reader = r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				body, _ = gzip.NewReader(r.Body)
+			}
+			payload, _ := ioutil.ReadAll(body)
+
+			lock.Lock()
+			status := responses[requests]
+			requests++
+			encodings = append(encodings, r.Header.Get("Content-Encoding"))
+			bodies = append(bodies, string(payload))
+			paths = append(paths, r.URL.Path)
+			lock.Unlock()
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "0")
+			}
+			w.WriteHeader(status)
+		}))
+
+		client = humio.NewHumioClient(&humio.HumioConfig{
+			Host:          server.URL,
+			Dataspace:     "test",
+			Token:         "token",
+			MaxRetries:    2,
+			MinRetryDelay: time.Millisecond,
+			MaxRetryDelay: 5 * time.Millisecond,
+		}, mocks.NewMockLogger())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("retries throttled and failed requests", func() {
+		responses = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusOK}
+
+		Expect(client.PushEvents(context.Background(), []humio.Events{})).To(Succeed())
+		Expect(requests).To(Equal(3))
+	})
+
+	It("gives up after the maximum number of retries", func() {
+		responses = []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}
+
+		err := client.PushEvents(context.Background(), []humio.Events{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*humio.IngestError).StatusCode).To(Equal(http.StatusBadGateway))
+		Expect(requests).To(Equal(3))
+	})
+
+	It("does not retry rejected requests", func() {
+		responses = []int{http.StatusUnauthorized}
+
+		err := client.PushEvents(context.Background(), []humio.Events{})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*humio.IngestError).Temporary()).To(BeFalse())
+		Expect(requests).To(Equal(1))
+	})
+
+	Context("with gzip enabled", func() {
+		BeforeEach(func() {
+			client = humio.NewHumioClient(&humio.HumioConfig{
+				Host:      server.URL,
+				Dataspace: "test",
+				Token:     "token",
+				Gzip:      true,
+				GzipLevel: 1,
+			}, mocks.NewMockLogger())
+		})
+
+		It("gzips the payload", func() {
+			responses = []int{http.StatusOK}
+
+			Expect(client.PushEvents(context.Background(), []humio.Events{})).To(Succeed())
+			Expect(encodings).To(Equal([]string{"gzip"}))
+			Expect(bodies).To(Equal([]string{"[]"}))
+		})
+
+		It("falls back to uncompressed payloads when gzip is rejected", func() {
+			responses = []int{http.StatusUnsupportedMediaType, http.StatusOK, http.StatusOK}
+
+			Expect(client.PushEvents(context.Background(), []humio.Events{})).To(Succeed())
+			Expect(client.PushEvents(context.Background(), []humio.Events{})).To(Succeed())
+			Expect(encodings).To(Equal([]string{"gzip", "", ""}))
+			Expect(bodies).To(Equal([]string{"[]", "[]", "[]"}))
+		})
+
+		It("keeps gzipping when Humio rejects a payload", func() {
+			responses = []int{http.StatusBadRequest, http.StatusOK}
+
+			Expect(client.PushEvents(context.Background(), []humio.Events{})).NotTo(Succeed())
+			Expect(client.PushEvents(context.Background(), []humio.Events{})).To(Succeed())
+			Expect(encodings).To(Equal([]string{"gzip", "gzip"}))
+		})
+	})
+
+	Context("with an ingest protocol", func() {
+		var events []humio.Events
+
+		newClient := func(protocol string) humio.HumioClient {
+			return humio.NewHumioClient(&humio.HumioConfig{
+				Host:      server.URL,
+				Dataspace: "test",
+				Token:     "token",
+				Protocol:  protocol,
+				Parser:    "accesslog",
+			}, mocks.NewMockLogger())
+		}
+
+		BeforeEach(func() {
+			responses = []int{http.StatusOK}
+			events = []humio.Events{{
+				Tags: humio.Tags{"appid": "app-1"},
+				Events: []humio.Event{{
+					Timestamp: "2017-11-12T10:00:00.5Z",
+					Attributes: humio.Attributes{
+						EventType: "LogMessage",
+						Job:       "router",
+						Log:       humio.LogAttribute{Message: "GET / 200"},
+					},
+				}},
+			}}
+		})
+
+		It("posts to the dataspace ingest API by default", func() {
+			Expect(newClient("").PushEvents(context.Background(), events)).To(Succeed())
+			Expect(paths).To(Equal([]string{"/api/v1/dataspaces/test/ingest"}))
+		})
+
+		It("posts structured events", func() {
+			Expect(newClient(humio.IngestStructured).PushEvents(context.Background(), events)).To(Succeed())
+			Expect(paths).To(Equal([]string{"/api/v1/ingest/humio-structured"}))
+			Expect(bodies[0]).To(ContainSubstring(`"tags":{"appid":"app-1"}`))
+		})
+
+		It("posts raw lines with the parser", func() {
+			Expect(newClient(humio.IngestUnstructured).PushEvents(context.Background(), events)).To(Succeed())
+			Expect(paths).To(Equal([]string{"/api/v1/ingest/humio-unstructured"}))
+			Expect(bodies[0]).To(MatchJSON(`[{"fields":{"appid":"app-1"},"messages":["GET / 200"],"type":"accesslog"}]`))
+		})
+
+		It("doesn't apply the parser to events other than log lines", func() {
+			events[0].Events = append(events[0].Events, humio.Event{
+				Timestamp:  "2017-11-12T10:00:00.5Z",
+				Attributes: humio.Attributes{EventType: "ValueMetric", Job: "router"},
+			})
+
+			Expect(newClient(humio.IngestUnstructured).PushEvents(context.Background(), events)).To(Succeed())
+			var groups []map[string]interface{}
+			Expect(json.Unmarshal([]byte(bodies[0]), &groups)).To(Succeed())
+			Expect(groups).To(HaveLen(2))
+			Expect(groups[0]["type"]).To(Equal("accesslog"))
+			Expect(groups[1]).NotTo(HaveKey("type"))
+			Expect(groups[1]["messages"]).To(ConsistOf(ContainSubstring(`"eventtype":"ValueMetric"`)))
+		})
+
+		It("posts HEC events", func() {
+			Expect(newClient(humio.IngestHEC).PushEvents(context.Background(), events)).To(Succeed())
+			Expect(paths).To(Equal([]string{"/api/v1/ingest/hec"}))
+			Expect(bodies[0]).To(HavePrefix(`{"time":1510480800.5,"source":"router","sourcetype":"LogMessage","fields":{"appid":"app-1"},"event":{`))
+		})
+	})
+})
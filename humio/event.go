@@ -1,7 +1,7 @@
 package humio
 
 import (
-	"math/big"
+	"strconv"
 	"strings"
 	"time"
 
@@ -9,12 +9,6 @@ import (
 	"github.com/humio/cloudfoundry2humio/caching"
 )
 
-type Tags struct {
-	OrgID     string `json:"orgid,omitempty"`
-	SpaceID   string `json:"spaceid,omitempty"`
-	AppID     string `json:"appid,omitempty"`
-}
-
 type OrganizationAttribute struct {
 	ID   string `json:"id,omitempty"`
 	Name string `json:"name,omitempty"`
@@ -31,33 +25,77 @@ type ApplicationAttribute struct {
 }
 
 type LogAttribute struct {
-	Message        string `json:"message"`
-	MessageType    string `json:"messagetype"`
-	Timestamp      string `json:"timestamp"`
-	SourceType     string `json:"sourcetype"`
-	SourceInstance string `json:"sourceinst"`
-	SourceTypeKey  string `json:"sourcetypekey"`
+	Message        string    `json:"message"`
+	MessageType    string    `json:"messagetype"`
+	Timestamp      Timestamp `json:"timestamp"`
+	SourceType     string    `json:"sourcetype"`
+	SourceInstance string    `json:"sourceinst"`
+	SourceTypeKey  string    `json:"sourcetypekey"`
 }
 
 type HTTPAttribute struct {
-	StartTimestamp string `json:"starttimestamp"`
-	StopTimestamp  string `json:"stoptimestamp"`
-	RequestID      string `json:"requestid"`
-	PeerType       string `json:"peertype"`
-	Method         string `json:"method"`
-	URI            string `json:"uri"`
-	RemoteAddress  string `json:"remoteaddr"`
-	UserAgent      string `json:"ua"`
-	StatusCode     int32  `json:"statuscode"`
-	ContentLength  int64  `json:"contentlength"`
-	InstanceIndex  int32  `json:"instanceindex"`
-	InstanceID     string `json:"instanceid"`
-	Forwarded      string `json:"forwarded"`
+	StartTimestamp Timestamp `json:"starttimestamp"`
+	StopTimestamp  Timestamp `json:"stoptimestamp"`
+	RequestID      string    `json:"requestid"`
+	PeerType       string    `json:"peertype"`
+	Method         string    `json:"method"`
+	URI            string    `json:"uri"`
+	RemoteAddress  string    `json:"remoteaddr"`
+	UserAgent      string    `json:"ua"`
+	StatusCode     int32     `json:"statuscode"`
+	ContentLength  int64     `json:"contentlength"`
+	InstanceIndex  int32     `json:"instanceindex"`
+	InstanceID     string    `json:"instanceid"`
+	Forwarded      string    `json:"forwarded"`
+	// the fields below are only parsed from Gorouter access logs
+	Host           string  `json:"host,omitempty"`
+	Path           string  `json:"path,omitempty"`
+	Protocol       string  `json:"protocol,omitempty"`
+	Referer        string  `json:"referer,omitempty"`
+	BackendAddress string  `json:"backendaddr,omitempty"`
+	BytesReceived  int64   `json:"bytesreceived,omitempty"`
+	ForwardedProto string  `json:"forwardedproto,omitempty"`
+	ResponseTime   float64 `json:"responsetime,omitempty"`
+	GorouterTime   float64 `json:"goroutertime,omitempty"`
+	TraceID        string  `json:"traceid,omitempty"`
+	// the fields below are only computed for HttpStartStop envelopes, the
+	// duration is nil unless both timestamps are set
+	DurationNS  *int64   `json:"duration_ns,omitempty"`
+	DurationMS  *float64 `json:"duration_ms,omitempty"`
+	StatusClass string   `json:"status_class,omitempty"`
+	Slow        bool     `json:"slow,omitempty"`
+}
+
+type ValueMetricAttribute struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+type CounterEventAttribute struct {
+	Name  string `json:"name"`
+	Delta uint64 `json:"delta"`
+	Total uint64 `json:"total"`
+}
+
+type ContainerMetricAttribute struct {
+	InstanceIndex    int32   `json:"instanceindex"`
+	CPUPercentage    float64 `json:"cpupercentage"`
+	MemoryBytes      uint64  `json:"memorybytes"`
+	DiskBytes        uint64  `json:"diskbytes"`
+	MemoryBytesQuota uint64  `json:"memorybytesquota"`
+	DiskBytesQuota   uint64  `json:"diskbytesquota"`
+}
+
+type ErrorAttribute struct {
+	Source  string `json:"source"`
+	Code    int32  `json:"code"`
+	Message string `json:"message"`
 }
 
 type Attributes struct {
 	EventType      string                `json:"eventtype"`
-	EventTime      string                `json:"timestamp"`
+	EventTime      Timestamp             `json:"timestamp"`
 	Deployment     string                `json:"deployment"`
 	Environment    string                `json:"env"`
 	Job            string                `json:"job"`
@@ -70,10 +108,17 @@ type Attributes struct {
 	App            ApplicationAttribute  `json:"app,omitempty"`
 	HTTP           HTTPAttribute         `json:"http,omitempty"`
 	Log            LogAttribute          `json:"log,omitempty"`
+	// the sections below are only present on their own envelope types
+	ValueMetric     *ValueMetricAttribute     `json:"metric,omitempty"`
+	CounterEvent    *CounterEventAttribute    `json:"counter,omitempty"`
+	ContainerMetric *ContainerMetricAttribute `json:"container,omitempty"`
+	Error           *ErrorAttribute           `json:"error,omitempty"`
+	// fields parsed from JSON log messages, keyed by their dotted path
+	Fields map[string]interface{} `json:"-"`
 }
 
 type Event struct {
-	Timestamp  string     `json:"timestamp"`
+	Timestamp  Timestamp  `json:"timestamp"`
 	Attributes Attributes `json:"attributes"`
 }
 
@@ -82,8 +127,34 @@ type Events struct {
 	Events []Event `json:"events"`
 }
 
-func NewEvent(e *events.Envelope, c caching.CachingClient) *Event {
-	var timestamp = formatTimestamp(e.GetTimestamp())
+// EventOptions tune how envelopes are mapped to Humio events. A nil
+// *EventOptions uses the defaults.
+type EventOptions struct {
+	// TimestampFormat is TimestampRFC3339Nano, the default, or
+	// TimestampEpochMillis
+	TimestampFormat string
+	// Location is the time zone of RFC 3339 timestamps, the local time zone
+	// when nil
+	Location *time.Location
+	// ParseJSONLogs adds the fields of log messages which are JSON objects
+	// to the attributes, under JSONPrefix, "json" by default. Nesting deeper
+	// than JSONMaxDepth is kept as JSON strings and fields past JSONMaxKeys
+	// are left out; zero values use the defaults of 3 and 100.
+	ParseJSONLogs bool
+	JSONPrefix    string
+	JSONMaxDepth  int
+	JSONMaxKeys   int
+	// ParseRTRLogs fills the HTTP section of Gorouter access logs
+	ParseRTRLogs bool
+	// SlowRequestThreshold flags HTTP requests taking at least as long as
+	// slow, zero disables the flag
+	SlowRequestThreshold time.Duration
+}
+
+// NewEvent maps the envelope to a Humio event, or returns nil for envelope
+// types Humio events aren't defined for. Options may be nil.
+func NewEvent(e *events.Envelope, c caching.CachingClient, o *EventOptions) *Event {
+	var timestamp = o.formatTimestamp(e.GetTimestamp())
 	var eventType = e.GetEventType()
 
 	var a = Attributes{
@@ -100,9 +171,17 @@ func NewEvent(e *events.Envelope, c caching.CachingClient) *Event {
 
 	switch t := eventType; t {
 	case events.Envelope_LogMessage:
-		AddLogMessageAttributes(&a, e, c)
+		AddLogMessageAttributes(&a, e, c, o)
 	case events.Envelope_HttpStartStop:
-		AddHTTPStartStopAttributes(&a, e, c)
+		AddHTTPStartStopAttributes(&a, e, c, o)
+	case events.Envelope_ValueMetric:
+		AddValueMetricAttributes(&a, e)
+	case events.Envelope_CounterEvent:
+		AddCounterEventAttributes(&a, e)
+	case events.Envelope_ContainerMetric:
+		AddContainerMetricAttributes(&a, e, c)
+	case events.Envelope_Error:
+		AddErrorAttributes(&a, e)
 	default:
 		return nil
 	}
@@ -115,11 +194,11 @@ func NewEvent(e *events.Envelope, c caching.CachingClient) *Event {
 	return &ev
 }
 
-func AddLogMessageAttributes(a *Attributes, e *events.Envelope, c caching.CachingClient) {
+func AddLogMessageAttributes(a *Attributes, e *events.Envelope, c caching.CachingClient, o *EventOptions) {
 	var m = e.GetLogMessage()
 
 	var l = LogAttribute{
-		Timestamp:      formatTimestamp(m.GetTimestamp()),
+		Timestamp:      o.formatTimestamp(m.GetTimestamp()),
 		SourceType:     m.GetSourceType(),
 		SourceInstance: m.GetSourceInstance(),
 	}
@@ -134,36 +213,27 @@ func AddLogMessageAttributes(a *Attributes, e *events.Envelope, c caching.Cachin
 	}
 
 	if m.AppId != nil {
-		var appInfo = c.GetAppInfo(*m.AppId)
-
-		var org = OrganizationAttribute{
-			ID:   appInfo.OrgID,
-			Name: appInfo.Org,
-		}
-		a.Org = org
+		addApplicationAttributes(a, *m.AppId, c)
+	}
 
-		var space = SpaceAttribute{
-			ID:   appInfo.SpaceID,
-			Name: appInfo.Space,
-		}
-		a.Space = space
+	if o != nil && o.ParseJSONLogs {
+		// the message is kept as it is, parsed or not
+		a.Fields = o.parseJSONLog(l.Message)
+	}
 
-		var app = ApplicationAttribute{
-			ID:   *m.AppId,
-			Name: appInfo.Name,
-		}
-		a.App = app
+	if o != nil && o.ParseRTRLogs && l.SourceType == rtrSourceType {
+		parseRTRLog(l.Message, &a.HTTP)
 	}
 
 	a.Log = l
 }
 
-func AddHTTPStartStopAttributes(a *Attributes, e *events.Envelope, c caching.CachingClient) {
+func AddHTTPStartStopAttributes(a *Attributes, e *events.Envelope, c caching.CachingClient, o *EventOptions) {
 	var m = e.GetHttpStartStop()
 
 	var h = HTTPAttribute{
-		StartTimestamp: formatTimestamp(m.GetStartTimestamp()),
-		StopTimestamp:  formatTimestamp(m.GetStopTimestamp()),
+		StartTimestamp: o.formatTimestamp(m.GetStartTimestamp()),
+		StopTimestamp:  o.formatTimestamp(m.GetStopTimestamp()),
 		PeerType:       m.GetPeerType().String(),
 		Method:         m.GetMethod().String(),
 		URI:            m.GetUri(),
@@ -179,38 +249,119 @@ func AddHTTPStartStopAttributes(a *Attributes, e *events.Envelope, c caching.Cac
 		h.RequestID = cfUUIDToString(m.RequestId)
 	}
 
+	if m.StartTimestamp != nil && m.StopTimestamp != nil {
+		duration := time.Duration(m.GetStopTimestamp() - m.GetStartTimestamp())
+		if duration < 0 {
+			// the clocks of the hosts stamping the start and the stop
+			// disagree, the request took no time as far as we can tell
+			duration = 0
+		}
+		ns := int64(duration)
+		ms := float64(duration) / float64(time.Millisecond)
+		h.DurationNS, h.DurationMS = &ns, &ms
+		h.Slow = o != nil && o.SlowRequestThreshold > 0 && duration >= o.SlowRequestThreshold
+	}
+
+	h.StatusClass = statusClass(h.StatusCode)
+
 	if e.HttpStartStop.GetForwarded() != nil {
 		h.Forwarded = strings.Join(e.GetHttpStartStop().GetForwarded(), ",")
 	}
 
 	if m.ApplicationId != nil {
-		id := cfUUIDToString(m.ApplicationId)
-		var appInfo = c.GetAppInfo(id)
+		addApplicationAttributes(a, cfUUIDToString(m.ApplicationId), c)
+	}
 
-		var org = OrganizationAttribute{
-			ID:   appInfo.OrgID,
-			Name: appInfo.Org,
-		}
-		a.Org = org
+	a.HTTP = h
+}
 
-		var space = SpaceAttribute{
-			ID:   appInfo.SpaceID,
-			Name: appInfo.Space,
-		}
-		a.Space = space
+func AddValueMetricAttributes(a *Attributes, e *events.Envelope) {
+	var m = e.GetValueMetric()
+
+	a.ValueMetric = &ValueMetricAttribute{
+		Name:  m.GetName(),
+		Value: m.GetValue(),
+		Unit:  m.GetUnit(),
+	}
+}
+
+func AddCounterEventAttributes(a *Attributes, e *events.Envelope) {
+	var m = e.GetCounterEvent()
+
+	a.CounterEvent = &CounterEventAttribute{
+		Name:  m.GetName(),
+		Delta: m.GetDelta(),
+		Total: m.GetTotal(),
+	}
+}
+
+func AddContainerMetricAttributes(a *Attributes, e *events.Envelope, c caching.CachingClient) {
+	var m = e.GetContainerMetric()
+
+	a.ContainerMetric = &ContainerMetricAttribute{
+		InstanceIndex:    m.GetInstanceIndex(),
+		CPUPercentage:    m.GetCpuPercentage(),
+		MemoryBytes:      m.GetMemoryBytes(),
+		DiskBytes:        m.GetDiskBytes(),
+		MemoryBytesQuota: m.GetMemoryBytesQuota(),
+		DiskBytesQuota:   m.GetDiskBytesQuota(),
+	}
+
+	if m.ApplicationId != nil {
+		addApplicationAttributes(a, m.GetApplicationId(), c)
+	}
+}
+
+func AddErrorAttributes(a *Attributes, e *events.Envelope) {
+	var m = e.GetError()
 
-		var app = ApplicationAttribute{
-			ID:   id,
-			Name: appInfo.Name,
+	a.Error = &ErrorAttribute{
+		Source:  m.GetSource(),
+		Code:    m.GetCode(),
+		Message: m.GetMessage(),
+	}
+}
+
+// EnvelopeAppID returns the GUID of the app the envelope is about, if any.
+func EnvelopeAppID(e *events.Envelope) string {
+	switch e.GetEventType() {
+	case events.Envelope_LogMessage:
+		return e.GetLogMessage().GetAppId()
+	case events.Envelope_HttpStartStop:
+		if id := e.GetHttpStartStop().GetApplicationId(); id != nil {
+			return cfUUIDToString(id)
 		}
-		a.App = app
+	case events.Envelope_ContainerMetric:
+		return e.GetContainerMetric().GetApplicationId()
 	}
+	return ""
+}
 
-	a.HTTP = h
+// addApplicationAttributes fills the org, space and app sections from the
+// app info cache.
+func addApplicationAttributes(a *Attributes, appID string, c caching.CachingClient) {
+	var appInfo = c.GetAppInfo(appID)
+
+	a.Org = OrganizationAttribute{
+		ID:   appInfo.OrgID,
+		Name: appInfo.Org,
+	}
+
+	a.Space = SpaceAttribute{
+		ID:   appInfo.SpaceID,
+		Name: appInfo.Space,
+	}
+
+	a.App = ApplicationAttribute{
+		ID:   appID,
+		Name: appInfo.Name,
+	}
 }
 
-func formatTimestamp(ts int64) string {
-	q, r := new(big.Int).DivMod(big.NewInt(ts), big.NewInt(1000000000), new(big.Int))
-	t := time.Unix(q.Int64(), r.Int64())
-	return t.Format(time.RFC3339)
+// statusClass returns the class of an HTTP status code, such as 2xx.
+func statusClass(code int32) string {
+	if code < 100 || code > 599 {
+		return ""
+	}
+	return strconv.Itoa(int(code/100)) + "xx"
 }
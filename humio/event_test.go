@@ -0,0 +1,213 @@
+package humio_test
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/humio/cloudfoundry2humio/caching"
+	"github.com/humio/cloudfoundry2humio/humio"
+	"github.com/humio/cloudfoundry2humio/mocks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Events", func() {
+	var (
+		cachingClient *mocks.MockCaching
+		envelope      *events.Envelope
+	)
+
+	BeforeEach(func() {
+		cachingClient = &mocks.MockCaching{
+			MockGetAppInfo: func(appGuid string) caching.AppInfo {
+				return caching.AppInfo{}
+			},
+		}
+
+		eventType := events.Envelope_LogMessage
+		messageType := events.LogMessage_OUT
+		timestamp := int64(1510480800123456789)
+		envelope = &events.Envelope{
+			EventType: &eventType,
+			Timestamp: &timestamp,
+			LogMessage: &events.LogMessage{
+				MessageType: &messageType,
+				Timestamp:   &timestamp,
+			},
+		}
+	})
+
+	Context("timestamps", func() {
+		It("keeps nanoseconds", func() {
+			event := humio.NewEvent(envelope, cachingClient, &humio.EventOptions{Location: time.UTC})
+			Expect(event.Timestamp).To(Equal(humio.Timestamp("2017-11-12T10:00:00.123456789Z")))
+			Expect(event.Attributes.EventTime).To(Equal(event.Timestamp))
+			Expect(event.Attributes.Log.Timestamp).To(Equal(event.Timestamp))
+		})
+
+		It("formats epoch milliseconds as numbers", func() {
+			event := humio.NewEvent(envelope, cachingClient, &humio.EventOptions{TimestampFormat: humio.TimestampEpochMillis})
+			payload, err := json.Marshal(event)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(payload)).To(HavePrefix(`{"timestamp":1510480800123,"attributes":{"eventtype":"LogMessage","timestamp":1510480800123,`))
+
+			var decoded humio.Event
+			Expect(json.Unmarshal(payload, &decoded)).To(Succeed())
+			Expect(decoded.Timestamp).To(Equal(humio.Timestamp("1510480800123")))
+			t, err := decoded.Timestamp.Time()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t.UnixNano()).To(Equal(int64(1510480800123000000)))
+		})
+	})
+
+	Context("JSON log messages", func() {
+		var options *humio.EventOptions
+
+		BeforeEach(func() {
+			options = &humio.EventOptions{ParseJSONLogs: true, JSONPrefix: "app", JSONMaxDepth: 2, JSONMaxKeys: 3}
+		})
+
+		It("adds the fields of JSON objects", func() {
+			envelope.LogMessage.Message = []byte(`{"level":"info","id":12345678901234567890,"req":{"path":"/","headers":{"a":"b"}}}`)
+
+			event := humio.NewEvent(envelope, cachingClient, options)
+			Expect(event.Attributes.Log.Message).To(Equal(string(envelope.LogMessage.Message)))
+			Expect(event.Attributes.Fields).To(Equal(map[string]interface{}{
+				"app.id":          json.Number("12345678901234567890"),
+				"app.level":       "info",
+				"app.req.headers": `{"a":"b"}`,
+			}))
+
+			payload, err := json.Marshal(event.Attributes)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(payload)).To(HaveSuffix(`"app.id":12345678901234567890,"app.level":"info","app.req.headers":"{\"a\":\"b\"}"}`))
+
+			var decoded humio.Attributes
+			Expect(json.Unmarshal(payload, &decoded)).To(Succeed())
+			Expect(decoded.Fields).To(Equal(event.Attributes.Fields))
+			Expect(decoded.Log.Message).To(Equal(event.Attributes.Log.Message))
+		})
+
+		It("keeps other messages as they are", func() {
+			for _, message := range []string{"plain text", `{"truncated":`, `{"a":1} {"b":2}`} {
+				envelope.LogMessage.Message = []byte(message)
+
+				event := humio.NewEvent(envelope, cachingClient, options)
+				Expect(event.Attributes.Log.Message).To(Equal(message))
+				Expect(event.Attributes.Fields).To(BeNil(), message)
+			}
+		})
+
+		It("is disabled by default", func() {
+			envelope.LogMessage.Message = []byte(`{"level":"info"}`)
+
+			Expect(humio.NewEvent(envelope, cachingClient, nil).Attributes.Fields).To(BeNil())
+		})
+	})
+
+	Context("Gorouter access logs", func() {
+		const accessLog = `www.example.com - [2019-01-28T22:15:09.157+0000] "GET /foo?bar=1 HTTP/1.1" 404 12 1234 "-" "curl/7.54.0" "10.0.0.1:54321" "10.0.1.5:61001" x_forwarded_for:"1.2.3.4, 10.0.0.1" x_forwarded_proto:"https" vcap_request_id:"8a0a4f3e-2f8b-4d3c-7b5e-1c2d3e4f5a6b" response_time:0.004560 gorouter_time:0.000123 app_id:"app-guid" app_index:"3" x_b3_traceid:"abc123" x_b3_spanid:"def456"`
+
+		var options *humio.EventOptions
+
+		BeforeEach(func() {
+			sourceType := "RTR"
+			envelope.LogMessage.SourceType = &sourceType
+			envelope.LogMessage.Message = []byte(accessLog)
+			options = &humio.EventOptions{ParseRTRLogs: true}
+		})
+
+		It("fills the HTTP section", func() {
+			event := humio.NewEvent(envelope, cachingClient, options)
+			Expect(event.Attributes.HTTP).To(Equal(humio.HTTPAttribute{
+				Host:           "www.example.com",
+				Method:         "GET",
+				URI:            "/foo?bar=1",
+				Path:           "/foo",
+				Protocol:       "HTTP/1.1",
+				StatusCode:     404,
+				BytesReceived:  12,
+				ContentLength:  1234,
+				UserAgent:      "curl/7.54.0",
+				RemoteAddress:  "10.0.0.1:54321",
+				BackendAddress: "10.0.1.5:61001",
+				Forwarded:      "1.2.3.4, 10.0.0.1",
+				ForwardedProto: "https",
+				RequestID:      "8a0a4f3e-2f8b-4d3c-7b5e-1c2d3e4f5a6b",
+				ResponseTime:   0.00456,
+				GorouterTime:   0.000123,
+				InstanceIndex:  3,
+				TraceID:        "abc123",
+			}))
+			Expect(event.Attributes.Log.Message).To(Equal(accessLog))
+		})
+
+		It("leaves other lines alone", func() {
+			envelope.LogMessage.Message = []byte("Updated app with guid app-guid")
+
+			Expect(humio.NewEvent(envelope, cachingClient, options).Attributes.HTTP).To(Equal(humio.HTTPAttribute{}))
+		})
+
+		It("only parses RTR logs", func() {
+			sourceType := "APP/PROC/WEB"
+			envelope.LogMessage.SourceType = &sourceType
+
+			Expect(humio.NewEvent(envelope, cachingClient, options).Attributes.HTTP).To(Equal(humio.HTTPAttribute{}))
+		})
+	})
+
+	Context("HTTP requests", func() {
+		BeforeEach(func() {
+			eventType := events.Envelope_HttpStartStop
+			start := int64(1510480800000000000)
+			stop := start + int64(1500*time.Microsecond)
+			statusCode := int32(503)
+			envelope = &events.Envelope{
+				EventType: &eventType,
+				HttpStartStop: &events.HttpStartStop{
+					StartTimestamp: &start,
+					StopTimestamp:  &stop,
+					StatusCode:     &statusCode,
+				},
+			}
+		})
+
+		It("computes the duration and status class", func() {
+			http := humio.NewEvent(envelope, cachingClient, nil).Attributes.HTTP
+			Expect(*http.DurationNS).To(Equal(int64(1500000)))
+			Expect(*http.DurationMS).To(Equal(1.5))
+			Expect(http.StatusClass).To(Equal("5xx"))
+			Expect(http.Slow).To(BeFalse())
+		})
+
+		It("keeps the duration of requests taking no time", func() {
+			envelope.HttpStartStop.StopTimestamp = envelope.HttpStartStop.StartTimestamp
+
+			http := humio.NewEvent(envelope, cachingClient, nil).Attributes.HTTP
+			Expect(http.DurationNS).To(Equal(new(int64)))
+			Expect(http.DurationMS).To(Equal(new(float64)))
+		})
+
+		It("clamps negative durations to zero", func() {
+			stop := envelope.HttpStartStop.GetStartTimestamp() - int64(time.Millisecond)
+			envelope.HttpStartStop.StopTimestamp = &stop
+
+			Expect(*humio.NewEvent(envelope, cachingClient, nil).Attributes.HTTP.DurationNS).To(BeZero())
+		})
+
+		It("leaves the duration out without both timestamps", func() {
+			envelope.HttpStartStop.StopTimestamp = nil
+
+			Expect(humio.NewEvent(envelope, cachingClient, nil).Attributes.HTTP.DurationNS).To(BeNil())
+		})
+
+		It("flags slow requests", func() {
+			options := &humio.EventOptions{SlowRequestThreshold: time.Millisecond}
+			Expect(humio.NewEvent(envelope, cachingClient, options).Attributes.HTTP.Slow).To(BeTrue())
+
+			options.SlowRequestThreshold = 2 * time.Millisecond
+			Expect(humio.NewEvent(envelope, cachingClient, options).Attributes.HTTP.Slow).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package humio_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestHumio(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Humio client Suite")
+}
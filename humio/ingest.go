@@ -0,0 +1,126 @@
+package humio
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// Ingest protocols supported by the client.
+const (
+	// IngestLegacy posts structured events to the dataspace ingest API.
+	IngestLegacy = "legacy"
+	// IngestStructured posts to /api/v1/ingest/humio-structured.
+	IngestStructured = "structured"
+	// IngestUnstructured posts raw lines to /api/v1/ingest/humio-unstructured
+	// to be parsed by the configured parser.
+	IngestUnstructured = "unstructured"
+	// IngestHEC posts to Humio's HTTP Event Collector compatible endpoint.
+	IngestHEC = "hec"
+)
+
+func (c *client) ingestURL() string {
+	switch c.config.Protocol {
+	case IngestStructured:
+		return c.config.Host + "/api/v1/ingest/humio-structured"
+	case IngestUnstructured:
+		return c.config.Host + "/api/v1/ingest/humio-unstructured"
+	case IngestHEC:
+		return c.config.Host + "/api/v1/ingest/hec"
+	}
+	return c.config.Host + "/api/v1/dataspaces/" + c.config.Dataspace + "/ingest"
+}
+
+// encode builds the request body of the configured ingest protocol.
+func (c *client) encode(events []Events) ([]byte, error) {
+	switch c.config.Protocol {
+	case IngestUnstructured:
+		return json.Marshal(unstructuredPayload(events, c.config.Parser))
+	case IngestHEC:
+		return hecPayload(events)
+	}
+	return json.Marshal(events)
+}
+
+type unstructuredGroup struct {
+	Fields   Tags     `json:"fields,omitempty"`
+	Messages []string `json:"messages"`
+	Type     string   `json:"type,omitempty"`
+}
+
+// unstructuredPayload sends application log lines as they were written so
+// that the parser sees the raw line. Events without a log line are sent as
+// their JSON attributes in a group of their own, which the parser meant for
+// log lines isn't applied to.
+func unstructuredPayload(events []Events, parser string) []unstructuredGroup {
+	groups := make([]unstructuredGroup, 0, len(events))
+	for _, e := range events {
+		logs := unstructuredGroup{Fields: e.Tags, Type: parser}
+		others := unstructuredGroup{Fields: e.Tags}
+		for _, ev := range e.Events {
+			if ev.Attributes.EventType == "LogMessage" {
+				logs.Messages = append(logs.Messages, ev.rawMessage())
+			} else {
+				others.Messages = append(others.Messages, ev.rawMessage())
+			}
+		}
+		if len(logs.Messages) > 0 {
+			groups = append(groups, logs)
+		}
+		if len(others.Messages) > 0 {
+			groups = append(groups, others)
+		}
+	}
+	return groups
+}
+
+type hecEvent struct {
+	Time       float64    `json:"time"`
+	Host       string     `json:"host,omitempty"`
+	Source     string     `json:"source,omitempty"`
+	SourceType string     `json:"sourcetype,omitempty"`
+	Fields     Tags       `json:"fields,omitempty"`
+	Event      Attributes `json:"event"`
+}
+
+// hecPayload concatenates one HEC event object per event.
+func hecPayload(events []Events) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, e := range events {
+		fields := e.Tags
+		for _, ev := range e.Events {
+			hec := hecEvent{
+				Time:       ev.epochSeconds(),
+				Host:       ev.Attributes.IP,
+				Source:     ev.Attributes.Job,
+				SourceType: ev.Attributes.EventType,
+				Fields:     fields,
+				Event:      ev.Attributes,
+			}
+			if err := encoder.Encode(hec); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (e Event) rawMessage() string {
+	if e.Attributes.EventType == "LogMessage" {
+		return e.Attributes.Log.Message
+	}
+	attributes, err := json.Marshal(e.Attributes)
+	if err != nil {
+		return ""
+	}
+	return string(attributes)
+}
+
+func (e Event) epochSeconds() float64 {
+	t, err := e.Timestamp.Time()
+	if err != nil {
+		t = time.Now()
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
@@ -0,0 +1,131 @@
+package humio
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultJSONPrefix   = "json"
+	defaultJSONMaxDepth = 3
+	defaultJSONMaxKeys  = 100
+)
+
+// attributes has the fields of Attributes without its JSON methods.
+type attributes Attributes
+
+// MarshalJSON adds the fields parsed from JSON log messages next to the
+// other attributes. Their keys all have a prefix followed by a dot, which
+// none of the other attributes have.
+func (a Attributes) MarshalJSON() ([]byte, error) {
+	payload, err := json.Marshal(attributes(a))
+	if err != nil || len(a.Fields) == 0 {
+		return payload, err
+	}
+
+	fields, err := json.Marshal(a.Fields)
+	if err != nil {
+		return nil, err
+	}
+	payload = append(payload[:len(payload)-1], ',')
+	return append(payload, fields[1:]...), nil
+}
+
+func (a *Attributes) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*attributes)(a)); err != nil {
+		return err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for k, v := range all {
+		if !strings.Contains(k, ".") {
+			continue
+		}
+		var value interface{}
+		if err := decodeJSON(v, &value); err != nil {
+			return err
+		}
+		if a.Fields == nil {
+			a.Fields = make(map[string]interface{})
+		}
+		a.Fields[k] = value
+	}
+	return nil
+}
+
+// parseJSONLog flattens the fields of a JSON object message into dotted keys
+// under the prefix. Objects nested deeper than the maximum depth are kept as
+// JSON strings, and keys past the maximum number of keys are left out. It
+// returns nil when the message isn't a JSON object.
+func (o *EventOptions) parseJSONLog(message string) map[string]interface{} {
+	message = strings.TrimSpace(message)
+	if !strings.HasPrefix(message, "{") || !strings.HasSuffix(message, "}") {
+		return nil
+	}
+
+	var object map[string]interface{}
+	if err := decodeJSON([]byte(message), &object); err != nil {
+		return nil
+	}
+
+	prefix, maxDepth, maxKeys := defaultJSONPrefix, defaultJSONMaxDepth, defaultJSONMaxKeys
+	if o.JSONPrefix != "" {
+		prefix = o.JSONPrefix
+	}
+	if o.JSONMaxDepth > 0 {
+		maxDepth = o.JSONMaxDepth
+	}
+	if o.JSONMaxKeys > 0 {
+		maxKeys = o.JSONMaxKeys
+	}
+
+	fields := make(map[string]interface{})
+	flattenJSON(fields, prefix, object, 1, maxDepth, maxKeys)
+	return fields
+}
+
+func flattenJSON(fields map[string]interface{}, prefix string, object map[string]interface{}, depth int, maxDepth int, maxKeys int) {
+	// sorted, so that the same keys are left out of every message
+	keys := make([]string, 0, len(object))
+	for k := range object {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if len(fields) >= maxKeys {
+			return
+		}
+		key := prefix + "." + k
+		nested, ok := object[k].(map[string]interface{})
+		switch {
+		case !ok:
+			fields[key] = object[k]
+		case depth < maxDepth:
+			flattenJSON(fields, key, nested, depth+1, maxDepth, maxKeys)
+		default:
+			encoded, _ := json.Marshal(nested)
+			fields[key] = string(encoded)
+		}
+	}
+}
+
+// decodeJSON keeps numbers as json.Number so that large integers survive.
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("unexpected data after JSON value")
+	}
+	return nil
+}
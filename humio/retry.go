@@ -0,0 +1,87 @@
+package humio
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// IngestError is returned when Humio answers an ingest request with a non
+// 200 status code.
+type IngestError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *IngestError) Error() string {
+	return fmt.Sprintf("Humio returned an unexpected response (%d): %s", e.StatusCode, e.Body)
+}
+
+// Temporary reports whether the request may succeed when retried. Other 4xx
+// responses mean the payload or token is rejected and retrying won't help.
+func (e *IngestError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+func newIngestError(resp *http.Response, body string) *IngestError {
+	return &IngestError{
+		StatusCode: resp.StatusCode,
+		Body:       body,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter accepts both forms of the Retry-After header, delay
+// seconds and an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// retryDelay returns how long to wait before retry n (starting at 1): the
+// server's Retry-After when given, otherwise a jittered exponential backoff.
+// Both are capped at the configured maximum delay.
+func (c *client) retryDelay(n int, err error) time.Duration {
+	max := c.config.MaxRetryDelay
+
+	if ingestErr, ok := err.(*IngestError); ok && ingestErr.RetryAfter > 0 {
+		if max > 0 && ingestErr.RetryAfter > max {
+			return max
+		}
+		return ingestErr.RetryAfter
+	}
+
+	delay := c.config.MinRetryDelay
+	for i := 1; i < n && (max <= 0 || delay < max); i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func isRetryable(err error) bool {
+	if ingestErr, ok := err.(*IngestError); ok {
+		return ingestErr.Temporary()
+	}
+	// transport errors
+	return true
+}
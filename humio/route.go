@@ -0,0 +1,89 @@
+package humio
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// DefaultRoute is the name of the route taking the events no other route
+// matched.
+const DefaultRoute = "default"
+
+var routeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// RouteMatch selects the events of a route. Empty fields match anything, Org,
+// Space and App match either the name or the GUID.
+type RouteMatch struct {
+	Org       string `json:"org,omitempty"`
+	Space     string `json:"space,omitempty"`
+	App       string `json:"app,omitempty"`
+	EventType string `json:"eventtype,omitempty"`
+}
+
+func (m RouteMatch) Matches(e *Event) bool {
+	a := e.Attributes
+	return matchesNameOrID(m.Org, a.Org.Name, a.Org.ID) &&
+		matchesNameOrID(m.Space, a.Space.Name, a.Space.ID) &&
+		matchesNameOrID(m.App, a.App.Name, a.App.ID) &&
+		(m.EventType == "" || m.EventType == a.EventType)
+}
+
+func matchesNameOrID(match string, name string, id string) bool {
+	return match == "" || match == name || match == id
+}
+
+// RouteConfig is an entry of the routing table. Host and Dataspace fall back
+// to the ones of the default route when empty.
+type RouteConfig struct {
+	Name      string     `json:"name"`
+	Match     RouteMatch `json:"match"`
+	Host      string     `json:"host,omitempty"`
+	Dataspace string     `json:"dataspace,omitempty"`
+	Token     string     `json:"token"`
+}
+
+// ParseRoutes parses a JSON routing table, e.g.
+//
+//	[{"name": "team-a", "match": {"org": "team-a"}, "token": "..."}]
+//
+// Routes are tried in order and the first matching one wins.
+func ParseRoutes(data string) ([]RouteConfig, error) {
+	if data == "" {
+		return nil, nil
+	}
+
+	var routes []RouteConfig
+	if err := json.Unmarshal([]byte(data), &routes); err != nil {
+		return nil, fmt.Errorf("invalid routing table: %s", err)
+	}
+
+	names := make(map[string]bool)
+	for _, r := range routes {
+		if !routeNamePattern.MatchString(r.Name) {
+			return nil, fmt.Errorf("invalid route name %q, use letters, digits, '-' and '_'", r.Name)
+		}
+		if r.Name == DefaultRoute || names[r.Name] {
+			return nil, fmt.Errorf("duplicate route name: %s", r.Name)
+		}
+		names[r.Name] = true
+		if r.Token == "" {
+			return nil, fmt.Errorf("missing token of route %s", r.Name)
+		}
+	}
+	return routes, nil
+}
+
+// Config returns the configuration of the route's client, derived from the
+// default route's configuration.
+func (r RouteConfig) Config(defaults *HumioConfig) *HumioConfig {
+	config := *defaults
+	if r.Host != "" {
+		config.Host = r.Host
+	}
+	if r.Dataspace != "" {
+		config.Dataspace = r.Dataspace
+	}
+	config.Token = r.Token
+	return &config
+}
@@ -0,0 +1,54 @@
+package humio_test
+
+import (
+	"github.com/humio/cloudfoundry2humio/humio"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Routes", func() {
+	event := &humio.Event{
+		Attributes: humio.Attributes{
+			EventType: "LogMessage",
+			Org:       humio.OrganizationAttribute{ID: "org-guid", Name: "team-a"},
+			Space:     humio.SpaceAttribute{ID: "space-guid", Name: "prod"},
+			App:       humio.ApplicationAttribute{ID: "app-guid", Name: "web"},
+		},
+	}
+
+	It("matches names, GUIDs and event types", func() {
+		Expect(humio.RouteMatch{}.Matches(event)).To(BeTrue())
+		Expect(humio.RouteMatch{Org: "team-a", Space: "space-guid"}.Matches(event)).To(BeTrue())
+		Expect(humio.RouteMatch{App: "app-guid", EventType: "LogMessage"}.Matches(event)).To(BeTrue())
+		Expect(humio.RouteMatch{Org: "team-b"}.Matches(event)).To(BeFalse())
+		Expect(humio.RouteMatch{Org: "team-a", EventType: "ContainerMetric"}.Matches(event)).To(BeFalse())
+	})
+
+	It("parses a routing table", func() {
+		routes, err := humio.ParseRoutes(`[{"name": "team-a", "match": {"org": "team-a"}, "dataspace": "a", "token": "secret"}]`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(routes).To(Equal([]humio.RouteConfig{{
+			Name:      "team-a",
+			Match:     humio.RouteMatch{Org: "team-a"},
+			Dataspace: "a",
+			Token:     "secret",
+		}}))
+
+		config := routes[0].Config(&humio.HumioConfig{Host: "https://humio", Dataspace: "main", Token: "main", Gzip: true})
+		Expect(*config).To(Equal(humio.HumioConfig{Host: "https://humio", Dataspace: "a", Token: "secret", Gzip: true}))
+	})
+
+	It("rejects invalid routes", func() {
+		for _, table := range []string{
+			`{"name": "team-a"}`,
+			`[{"name": "", "token": "secret"}]`,
+			`[{"name": "../a", "token": "secret"}]`,
+			`[{"name": "default", "token": "secret"}]`,
+			`[{"name": "a", "token": "secret"}, {"name": "a", "token": "secret"}]`,
+			`[{"name": "a"}]`,
+		} {
+			_, err := humio.ParseRoutes(table)
+			Expect(err).To(HaveOccurred(), table)
+		}
+	})
+})
@@ -0,0 +1,79 @@
+package humio
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rtrSourceType is the source type of Gorouter access logs.
+const rtrSourceType = "RTR"
+
+// rtrPattern matches the fixed part of a Gorouter access log line:
+//
+//	<host> - [<start>] "<method> <url> <protocol>" <status> <bytes received> <bytes sent> "<referer>" "<user agent>" "<remote address>" "<backend address>" <key:value fields>
+var rtrPattern = regexp.MustCompile(`^(\S+) - \[([^\]]*)\] "(\S+) (\S+) ([^"]*)" (\d+) (\d+) (\d+) "([^"]*)" "([^"]*)" "([^"]*)" "([^"]*)"(.*)$`)
+
+// rtrFieldPattern matches the key:value and key:"value" fields which follow.
+var rtrFieldPattern = regexp.MustCompile(`(\w+):("([^"]*)"|\S*)`)
+
+// parseRTRLog fills the HTTP section from a Gorouter access log line and
+// reports whether the line could be parsed.
+func parseRTRLog(message string, h *HTTPAttribute) bool {
+	m := rtrPattern.FindStringSubmatch(strings.TrimSpace(message))
+	if m == nil {
+		return false
+	}
+
+	h.Host = m[1]
+	h.Method = m[3]
+	h.URI = m[4]
+	h.Path = m[4]
+	if i := strings.IndexByte(h.Path, '?'); i >= 0 {
+		h.Path = h.Path[:i]
+	}
+	h.Protocol = m[5]
+	status, _ := strconv.ParseInt(m[6], 10, 32)
+	h.StatusCode = int32(status)
+	h.BytesReceived, _ = strconv.ParseInt(m[7], 10, 64)
+	h.ContentLength, _ = strconv.ParseInt(m[8], 10, 64)
+	h.Referer = rtrValue(m[9])
+	h.UserAgent = rtrValue(m[10])
+	h.RemoteAddress = rtrValue(m[11])
+	h.BackendAddress = rtrValue(m[12])
+
+	for _, f := range rtrFieldPattern.FindAllStringSubmatch(m[13], -1) {
+		value := f[2]
+		if strings.HasPrefix(value, `"`) {
+			value = f[3]
+		}
+		value = rtrValue(value)
+
+		switch f[1] {
+		case "x_forwarded_for":
+			h.Forwarded = value
+		case "x_forwarded_proto":
+			h.ForwardedProto = value
+		case "vcap_request_id":
+			h.RequestID = value
+		case "response_time":
+			h.ResponseTime, _ = strconv.ParseFloat(value, 64)
+		case "gorouter_time":
+			h.GorouterTime, _ = strconv.ParseFloat(value, 64)
+		case "app_index":
+			index, _ := strconv.ParseInt(value, 10, 32)
+			h.InstanceIndex = int32(index)
+		case "x_b3_traceid":
+			h.TraceID = value
+		}
+	}
+	return true
+}
+
+// rtrValue maps the "-" Gorouter logs for missing values to empty strings.
+func rtrValue(v string) string {
+	if v == "-" {
+		return ""
+	}
+	return v
+}
@@ -0,0 +1,95 @@
+package humio
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tags are the fields Humio indexes events by. Every distinct set of tags is
+// its own Humio datasource, so the fewer values a tag has the better.
+type Tags map[string]string
+
+// key identifies the set of tags in a batch.
+func (t Tags) key() string {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(t[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// tagFields are the attributes which can be used as tags.
+var tagFields = map[string]func(*Attributes) *string{
+	"orgid":      func(a *Attributes) *string { return &a.Org.ID },
+	"org":        func(a *Attributes) *string { return &a.Org.Name },
+	"spaceid":    func(a *Attributes) *string { return &a.Space.ID },
+	"space":      func(a *Attributes) *string { return &a.Space.Name },
+	"appid":      func(a *Attributes) *string { return &a.App.ID },
+	"app":        func(a *Attributes) *string { return &a.App.Name },
+	"eventtype":  func(a *Attributes) *string { return &a.EventType },
+	"deployment": func(a *Attributes) *string { return &a.Deployment },
+	"env":        func(a *Attributes) *string { return &a.Environment },
+	"job":        func(a *Attributes) *string { return &a.Job },
+	"index":      func(a *Attributes) *string { return &a.Index },
+	"ip":         func(a *Attributes) *string { return &a.IP },
+	"sourcetype": func(a *Attributes) *string { return &a.Log.SourceType },
+}
+
+// TagSelector lists the attributes that become tags. Tagged attributes stay in
+// the event's attributes unless they are removed with Untag.
+type TagSelector []string
+
+// DefaultTags tags events with their org, space and app GUIDs.
+var DefaultTags = TagSelector{"orgid", "spaceid", "appid"}
+
+// ParseTagSelector parses a comma separated list of tag names, e.g.
+// "env,org". An empty list tags no attribute at all.
+func ParseTagSelector(s string) (TagSelector, error) {
+	selector := TagSelector{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := tagFields[name]; !ok {
+			return nil, fmt.Errorf("unknown tag: %s", name)
+		}
+		selector = append(selector, name)
+	}
+	return selector, nil
+}
+
+// Tags returns the tags of the event, leaving out empty attributes.
+func (s TagSelector) Tags(e *Event) Tags {
+	tags := make(Tags, len(s))
+	for _, name := range s {
+		field, ok := tagFields[name]
+		if !ok {
+			continue
+		}
+		if value := *field(&e.Attributes); value != "" {
+			tags[name] = value
+		}
+	}
+	return tags
+}
+
+// Untag clears the tagged attributes of the event, so that Humio only has
+// them as tags.
+func (s TagSelector) Untag(e *Event) {
+	for _, name := range s {
+		if field, ok := tagFields[name]; ok {
+			*field(&e.Attributes) = ""
+		}
+	}
+}
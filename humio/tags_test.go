@@ -0,0 +1,56 @@
+package humio_test
+
+import (
+	"github.com/humio/cloudfoundry2humio/humio"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tags", func() {
+	event := &humio.Event{
+		Attributes: humio.Attributes{
+			EventType:   "LogMessage",
+			Environment: "prod",
+			Org:         humio.OrganizationAttribute{ID: "org-guid", Name: "team-a"},
+			App:         humio.ApplicationAttribute{ID: "app-guid"},
+		},
+	}
+
+	It("tags events with their org, space and app GUIDs by default", func() {
+		Expect(humio.DefaultTags.Tags(event)).To(Equal(humio.Tags{"orgid": "org-guid", "appid": "app-guid"}))
+	})
+
+	It("tags events with the selected attributes", func() {
+		selector, err := humio.ParseTagSelector("env, org ,EventType")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(selector.Tags(event)).To(Equal(humio.Tags{"env": "prod", "org": "team-a", "eventtype": "LogMessage"}))
+	})
+
+	It("clears the tagged attributes of events", func() {
+		untagged := *event
+		humio.DefaultTags.Untag(&untagged)
+
+		Expect(untagged.Attributes.Org).To(Equal(humio.OrganizationAttribute{Name: "team-a"}))
+		Expect(untagged.Attributes.App.ID).To(BeEmpty())
+		Expect(untagged.Attributes.Environment).To(Equal("prod"))
+		Expect(event.Attributes.Org.ID).To(Equal("org-guid"))
+	})
+
+	It("rejects unknown tags", func() {
+		_, err := humio.ParseTagSelector("env,color")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("groups events with the same tags in a batch", func() {
+		batch := humio.NewBatch()
+		batch.Add(humio.Tags{"env": "prod", "org": "a"}, humio.Event{})
+		batch.Add(humio.Tags{"org": "a", "env": "prod"}, humio.Event{})
+		batch.Add(humio.Tags{"env": "prod"}, humio.Event{})
+		batch.Add(nil, humio.Event{})
+
+		Expect(batch.Len()).To(Equal(4))
+		Expect(batch.Groups()).To(HaveLen(3))
+		Expect(batch.Groups()[0].Events).To(HaveLen(2))
+		Expect(batch.Groups()[2].Tags).To(Equal(humio.Tags{}))
+	})
+})
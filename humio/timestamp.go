@@ -0,0 +1,66 @@
+package humio
+
+import (
+	"strconv"
+	"time"
+)
+
+// Timestamp formats.
+const (
+	// TimestampRFC3339Nano keeps the nanoseconds of the envelope timestamps.
+	TimestampRFC3339Nano = "rfc3339nano"
+	// TimestampEpochMillis sends milliseconds since the epoch as numbers.
+	TimestampEpochMillis = "epochmillis"
+)
+
+// Timestamp is either an RFC 3339 string or milliseconds since the epoch,
+// which is encoded as a JSON number.
+type Timestamp string
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.isEpochMillis() {
+		return []byte(t), nil
+	}
+	return []byte(strconv.Quote(string(t))), nil
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	*t = Timestamp(s)
+	return nil
+}
+
+func (t Timestamp) isEpochMillis() bool {
+	_, err := strconv.ParseInt(string(t), 10, 64)
+	return err == nil
+}
+
+// Time parses the timestamp back into a time.
+func (t Timestamp) Time() (time.Time, error) {
+	if t.isEpochMillis() {
+		ms, _ := strconv.ParseInt(string(t), 10, 64)
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	return time.Parse(time.RFC3339Nano, string(t))
+}
+
+// formatTimestamp formats nanoseconds since the epoch.
+func (o *EventOptions) formatTimestamp(ts int64) Timestamp {
+	if o != nil && o.TimestampFormat == TimestampEpochMillis {
+		// floor, so that timestamps before the epoch round the same way
+		ms := ts / int64(time.Millisecond)
+		if ts%int64(time.Millisecond) < 0 {
+			ms--
+		}
+		return Timestamp(strconv.FormatInt(ms, 10))
+	}
+
+	t := time.Unix(0, ts)
+	if o != nil && o.Location != nil {
+		t = t.In(o.Location)
+	}
+	return Timestamp(t.Format(time.RFC3339Nano))
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"regexp"
 	"runtime/pprof"
 	"strings"
 	"syscall"
@@ -23,7 +26,14 @@ const (
 
 var (
 	apiAddress     = kingpin.Flag("api-addr", "Api URL").OverrideDefaultFromEnvar("API_ADDR").Required().String()
-	dopplerAddress = kingpin.Flag("doppler-addr", "Traffic controller URL").OverrideDefaultFromEnvar("DOPPLER_ADDR").Required().String()
+	dopplerAddress = kingpin.Flag("doppler-addr", "Traffic controller URL").OverrideDefaultFromEnvar("DOPPLER_ADDR").String()
+	firehoseSource = kingpin.Flag("firehose-source", "Event source: firehose (V1 traffic controller), rlp (V2 Reverse Log Proxy gateway) or syslog (syslog drain receiver)").Default("firehose").OverrideDefaultFromEnvar("FIREHOSE_SOURCE").Enum("firehose", "rlp", "syslog")
+	rlpAddress     = kingpin.Flag("rlp-gateway-addr", "Reverse Log Proxy gateway URL").OverrideDefaultFromEnvar("RLP_GATEWAY_ADDR").String()
+	rlpSourceIDs   = kingpin.Flag("rlp-source-ids", "Comma separated source ids to read from the RLP gateway, empty reads all").Default("").OverrideDefaultFromEnvar("RLP_SOURCE_IDS").String()
+	syslogAddress  = kingpin.Flag("syslog-listen-addr", "Address the syslog drain receiver listens on, the port CF assigns in PORT by default").Default(defaultSyslogAddress()).OverrideDefaultFromEnvar("SYSLOG_LISTEN_ADDR").String()
+	syslogTLSCert  = kingpin.Flag("syslog-tls-cert", "TLS certificate file for the syslog drain receiver, plain TCP when empty").Default("").OverrideDefaultFromEnvar("SYSLOG_TLS_CERT").String()
+	syslogTLSKey   = kingpin.Flag("syslog-tls-key", "TLS private key file for the syslog drain receiver").Default("").OverrideDefaultFromEnvar("SYSLOG_TLS_KEY").String()
+	syslogIdle     = kingpin.Flag("syslog-idle-timeout", "Time a syslog drain connection may stay silent before it is closed, 0 keeps it open").Default("0s").OverrideDefaultFromEnvar("SYSLOG_IDLE_TIMEOUT").Duration()
 	cfUser         = kingpin.Flag("firehose-user", "CF user with admin and firehose access").OverrideDefaultFromEnvar("FIREHOSE_USER").Required().String()
 	cfPassword     = kingpin.Flag("firehose-user-password", "Password of the CF user").OverrideDefaultFromEnvar("FIREHOSE_USER_PASSWORD").Required().String()
 	environment    = kingpin.Flag("cf-environment", "CF environment name").OverrideDefaultFromEnvar("CF_ENVIRONMENT").Default("cf").String()
@@ -33,11 +43,52 @@ var (
 	skipSslValidation = kingpin.Flag("skip-ssl-validation", "Skip SSL validation").Default("false").OverrideDefaultFromEnvar("SKIP_SSL_VALIDATION").Bool()
 	idleTimeout       = kingpin.Flag("idle-timeout", "Keep Alive duration for the firehose consumer").Default("25s").OverrideDefaultFromEnvar("IDLE_TIMEOUT").Duration()
 	logLevel          = kingpin.Flag("log-level", "Log level: DEBUG, INFO, ERROR").Default("INFO").OverrideDefaultFromEnvar("LOG_LEVEL").String()
+	minReconnectDelay = kingpin.Flag("min-reconnect-delay", "Initial delay before reconnecting to the firehose").Default("1s").OverrideDefaultFromEnvar("MIN_RECONNECT_DELAY").Duration()
+	maxReconnectDelay = kingpin.Flag("max-reconnect-delay", "Maximum delay between firehose reconnect attempts").Default("60s").OverrideDefaultFromEnvar("MAX_RECONNECT_DELAY").Duration()
+	maxReconnects     = kingpin.Flag("max-reconnect-retries", "Consecutive firehose reconnect attempts before exiting, 0 retries forever").Default("10").OverrideDefaultFromEnvar("MAX_RECONNECT_RETRIES").Int()
+	spoolDir          = kingpin.Flag("spool-dir", "Directory of the on-disk buffer keeping batches while Humio is unreachable, disabled when empty").Default("").OverrideDefaultFromEnvar("SPOOL_DIR").String()
+	spoolMaxSize      = kingpin.Flag("spool-max-size", "Maximum size of the on-disk buffer before the oldest batches are dropped").Default("512MB").OverrideDefaultFromEnvar("SPOOL_MAX_SIZE").Bytes()
+	drainTimeout      = kingpin.Flag("drain-timeout", "Time allowed on shutdown to flush pending events to Humio").Default("8s").OverrideDefaultFromEnvar("DRAIN_TIMEOUT").Duration()
+	senderWorkers     = kingpin.Flag("sender-workers", "Number of concurrent Humio senders").Default("4").OverrideDefaultFromEnvar("SENDER_WORKERS").Int()
+	senderQueueSize   = kingpin.Flag("sender-queue-size", "Number of batches waiting for a Humio sender").Default("8").OverrideDefaultFromEnvar("SENDER_QUEUE_SIZE").Int()
+	overflowPolicy    = kingpin.Flag("overflow-policy", "What to do when the sender queue is full: block, drop-oldest or drop-newest").Default("block").OverrideDefaultFromEnvar("OVERFLOW_POLICY").Enum("block", "drop-oldest", "drop-newest")
+	eventTypes        = kingpin.Flag("event-types", "Envelope types to subscribe to: all, logs, metrics or a comma separated list such as LogMessage,HttpStartStop").Default("all").OverrideDefaultFromEnvar("EVENT_TYPES").String()
 
 	// Humio endpoint info
 	humioHost        = kingpin.Flag("humio-host", "Humio host endpoint").OverrideDefaultFromEnvar("HUMIO_HOST").Required().String()
-	humioDataspace   = kingpin.Flag("humio-dataspace", "Humio dataspace to push logs to").OverrideDefaultFromEnvar("HUMIO_DATASPACE").Required().String()
+	humioDataspace   = kingpin.Flag("humio-dataspace", "Humio dataspace to push logs to, required with the legacy ingest protocol").OverrideDefaultFromEnvar("HUMIO_DATASPACE").String()
 	humioIngestToken = kingpin.Flag("humio-ingest-token", "Humio ingest token").OverrideDefaultFromEnvar("HUMIO_INGEST_TOKEN").Required().String()
+	humioMaxRetries  = kingpin.Flag("humio-max-retries", "Retries of a failed Humio ingest request before its events are dropped").Default("5").OverrideDefaultFromEnvar("HUMIO_MAX_RETRIES").Int()
+	humioMinRetry    = kingpin.Flag("humio-min-retry-delay", "Initial delay before retrying a failed Humio ingest request").Default("1s").OverrideDefaultFromEnvar("HUMIO_MIN_RETRY_DELAY").Duration()
+	humioMaxRetry    = kingpin.Flag("humio-max-retry-delay", "Maximum delay between Humio ingest retries").Default("30s").OverrideDefaultFromEnvar("HUMIO_MAX_RETRY_DELAY").Duration()
+	humioTimeout     = kingpin.Flag("humio-request-timeout", "Timeout of a single Humio ingest request").Default("10s").OverrideDefaultFromEnvar("HUMIO_REQUEST_TIMEOUT").Duration()
+	humioRespTimeout = kingpin.Flag("humio-response-header-timeout", "Time to wait for Humio's response headers, 0 only applies the request timeout").Default("0s").OverrideDefaultFromEnvar("HUMIO_RESPONSE_HEADER_TIMEOUT").Duration()
+	humioIdleTimeout = kingpin.Flag("humio-idle-conn-timeout", "How long idle connections to Humio are kept open").Default("90s").OverrideDefaultFromEnvar("HUMIO_IDLE_CONN_TIMEOUT").Duration()
+	humioGzip        = kingpin.Flag("humio-gzip", "Gzip Humio ingest requests").Default("false").OverrideDefaultFromEnvar("HUMIO_GZIP").Bool()
+	humioGzipLevel   = kingpin.Flag("humio-gzip-level", "Gzip level from 1 (fastest) to 9 (best), -1 for the default").Default("-1").OverrideDefaultFromEnvar("HUMIO_GZIP_LEVEL").Int()
+	humioMaxIdle     = kingpin.Flag("humio-max-idle-conns", "Number of idle connections to Humio kept in the pool").Default("16").OverrideDefaultFromEnvar("HUMIO_MAX_IDLE_CONNS").Int()
+	humioProtocol    = kingpin.Flag("humio-ingest-protocol", "Humio ingest API: legacy (dataspace ingest), structured, unstructured or hec").Default("legacy").OverrideDefaultFromEnvar("HUMIO_INGEST_PROTOCOL").Enum(humio.IngestLegacy, humio.IngestStructured, humio.IngestUnstructured, humio.IngestHEC)
+	timestampFormat  = kingpin.Flag("timestamp-format", "Format of event timestamps: rfc3339nano or epochmillis").Default(humio.TimestampRFC3339Nano).OverrideDefaultFromEnvar("TIMESTAMP_FORMAT").Enum(humio.TimestampRFC3339Nano, humio.TimestampEpochMillis)
+	timestampZone    = kingpin.Flag("timestamp-timezone", "Time zone of rfc3339nano timestamps, e.g. UTC or Europe/Copenhagen").Default("Local").OverrideDefaultFromEnvar("TIMESTAMP_TIMEZONE").String()
+	parseJSONLogs    = kingpin.Flag("parse-json-logs", "Add the fields of JSON log messages to the event attributes").Default("false").OverrideDefaultFromEnvar("PARSE_JSON_LOGS").Bool()
+	jsonLogPrefix    = kingpin.Flag("json-log-prefix", "Prefix of the fields parsed from JSON log messages").Default("json").OverrideDefaultFromEnvar("JSON_LOG_PREFIX").String()
+	jsonLogMaxDepth  = kingpin.Flag("json-log-max-depth", "Nesting of JSON log messages parsed into fields, deeper objects are kept as JSON strings").Default("3").OverrideDefaultFromEnvar("JSON_LOG_MAX_DEPTH").Int()
+	jsonLogMaxKeys   = kingpin.Flag("json-log-max-keys", "Maximum number of fields parsed from a JSON log message").Default("100").OverrideDefaultFromEnvar("JSON_LOG_MAX_KEYS").Int()
+	parseRTRLogs     = kingpin.Flag("parse-rtr-logs", "Fill the HTTP fields of events from Gorouter access logs").Default("false").OverrideDefaultFromEnvar("PARSE_RTR_LOGS").Bool()
+	slowRequest      = kingpin.Flag("slow-request-threshold", "Duration from which HTTP requests are flagged as slow, 0 disables the flag").Default("0s").OverrideDefaultFromEnvar("SLOW_REQUEST_THRESHOLD").Duration()
+	multiline        = kingpin.Flag("multiline", "Join log lines such as stack traces to the log record they continue").Default("false").OverrideDefaultFromEnvar("MULTILINE").Bool()
+	multilineStart   = kingpin.Flag("multiline-start-pattern", "Regular expression matching the first line of a log record").Default(`^\S`).OverrideDefaultFromEnvar("MULTILINE_START_PATTERN").String()
+	multilineLines   = kingpin.Flag("multiline-max-lines", "Maximum number of lines joined into a log record").Default("100").OverrideDefaultFromEnvar("MULTILINE_MAX_LINES").Int()
+	multilineTimeout = kingpin.Flag("multiline-flush-timeout", "Time after the last line of a log record before it is sent").Default("1s").OverrideDefaultFromEnvar("MULTILINE_FLUSH_TIMEOUT").Duration()
+	appCacheTTL      = kingpin.Flag("app-cache-ttl", "How long app, space and org names are cached before they are looked up again, 0 caches them forever").Default("10m").OverrideDefaultFromEnvar("APP_CACHE_TTL").Duration()
+	appCacheNegTTL   = kingpin.Flag("app-cache-negative-ttl", "How long apps which could not be looked up, such as system components, are not looked up again").Default("5m").OverrideDefaultFromEnvar("APP_CACHE_NEGATIVE_TTL").Duration()
+	appCachePageSize = kingpin.Flag("app-cache-page-size", "Number of apps loaded per Cloud Controller request, at most 5000").Default("1000").OverrideDefaultFromEnvar("APP_CACHE_PAGE_SIZE").Int()
+	enrichTimeout    = kingpin.Flag("enrich-timeout", "Time events of apps missing from the cache wait for the app to be looked up before they are sent without app info").Default("2s").OverrideDefaultFromEnvar("ENRICH_TIMEOUT").Duration()
+	enrichWorkers    = kingpin.Flag("enrich-workers", "Number of concurrent app lookups").Default("4").OverrideDefaultFromEnvar("ENRICH_WORKERS").Int()
+	humioTags        = kingpin.Flag("humio-tags", "Comma separated attributes used as Humio tags, see the README for the available attributes").Default("orgid,spaceid,appid").OverrideDefaultFromEnvar("HUMIO_TAGS").String()
+	humioTagsOnly    = kingpin.Flag("humio-tags-only", "Send tagged attributes only as Humio tags and leave them out of the event attributes").Default("false").OverrideDefaultFromEnvar("HUMIO_TAGS_ONLY").Bool()
+	humioRoutes      = kingpin.Flag("humio-routes", "JSON routing table sending matching events to other Humio dataspaces and tokens").Default("").OverrideDefaultFromEnvar("HUMIO_ROUTES").String()
+	humioParser      = kingpin.Flag("humio-parser", "Humio parser applied to application log lines with the unstructured ingest protocol").Default("").OverrideDefaultFromEnvar("HUMIO_PARSER").String()
 )
 
 func main() {
@@ -59,6 +110,47 @@ func main() {
 	defer close(threadDumpChan)
 	go dumpGoRoutine(threadDumpChan)
 
+	eventSubscription, err := nozzle.ParseEventSubscription(*eventTypes)
+	if err != nil {
+		logger.Fatal("invalid event types", err)
+	}
+
+	if *humioGzipLevel < -1 || *humioGzipLevel > 9 {
+		logger.Fatal("invalid gzip level", fmt.Errorf("gzip level must be between -1 and 9, got %d", *humioGzipLevel))
+	}
+
+	if *humioProtocol == humio.IngestLegacy && *humioDataspace == "" {
+		logger.Fatal("missing Humio dataspace", errors.New("--humio-dataspace is required with --humio-ingest-protocol=legacy"))
+	}
+
+	timestampLocation, err := time.LoadLocation(*timestampZone)
+	if err != nil {
+		logger.Fatal("invalid timestamp time zone", err)
+	}
+
+	var multilineConfig *nozzle.MultilineConfig
+	if *multiline {
+		startPattern, err := regexp.Compile(*multilineStart)
+		if err != nil {
+			logger.Fatal("invalid multiline start pattern", err)
+		}
+		multilineConfig = &nozzle.MultilineConfig{
+			StartPattern: startPattern,
+			MaxLines:     *multilineLines,
+			FlushTimeout: *multilineTimeout,
+		}
+	}
+
+	tagSelector, err := humio.ParseTagSelector(*humioTags)
+	if err != nil {
+		logger.Fatal("invalid Humio tags", err)
+	}
+
+	senderOverflowPolicy, err := nozzle.ParseOverflowPolicy(*overflowPolicy)
+	if err != nil {
+		logger.Fatal("invalid overflow policy", err)
+	}
+
 	cachingCFClientConfig := &cfclient.Config{
 		ApiAddress:        *apiAddress,
 		Username:          *cfUser,
@@ -66,7 +158,13 @@ func main() {
 		SkipSslValidation: *skipSslValidation,
 	}
 
-	cachingClient := caching.NewCaching(cachingCFClientConfig, logger, *environment)
+	cacheConfig := &caching.CacheConfig{
+		TTL:         *appCacheTTL,
+		NegativeTTL: *appCacheNegTTL,
+		PageSize:    *appCachePageSize,
+	}
+
+	cachingClient := caching.NewCaching(cachingCFClientConfig, cacheConfig, logger, *environment)
 
 	firehoseCFClientConfig := &cfclient.Config{
 		ApiAddress:        *apiAddress,
@@ -79,25 +177,122 @@ func main() {
 		SubscriptionId:       firehoseSubscriptionID,
 		TrafficControllerUrl: *dopplerAddress,
 		IdleTimeout:          *idleTimeout,
+		EventSubscription:    eventSubscription,
+		RLPGatewayUrl:        *rlpAddress,
+		RLPSourceIDs:         splitList(*rlpSourceIDs),
 	}
 
-	firehoseClient := nozzle.NewFirehoseClient(firehoseCFClientConfig, firehoseConfig, logger)
+	var firehoseClient nozzle.FirehoseClient
+	switch *firehoseSource {
+	case "rlp":
+		if *rlpAddress == "" {
+			logger.Fatal("missing RLP gateway address", errors.New("--rlp-gateway-addr is required with --firehose-source=rlp"))
+		}
+		firehoseClient = nozzle.NewRLPGatewayClient(firehoseCFClientConfig, firehoseConfig, logger)
+	case "syslog":
+		syslogConfig := &nozzle.SyslogConfig{
+			ListenAddress: *syslogAddress,
+			TLSCertFile:   *syslogTLSCert,
+			TLSKeyFile:    *syslogTLSKey,
+			IdleTimeout:   *syslogIdle,
+		}
+		firehoseClient = nozzle.NewSyslogReceiver(syslogConfig, logger)
+	default:
+		if *dopplerAddress == "" {
+			logger.Fatal("missing traffic controller address", errors.New("--doppler-addr is required with --firehose-source=firehose"))
+		}
+		firehoseClient = nozzle.NewFirehoseClient(firehoseCFClientConfig, firehoseConfig, logger)
+	}
 
 	humioConfig := &humio.HumioConfig{
-		Host:      *humioHost,
-		Dataspace: *humioDataspace,
-		Token:     *humioIngestToken,
+		Host:                  *humioHost,
+		Dataspace:             *humioDataspace,
+		Token:                 *humioIngestToken,
+		MaxRetries:            *humioMaxRetries,
+		MinRetryDelay:         *humioMinRetry,
+		MaxRetryDelay:         *humioMaxRetry,
+		RequestTimeout:        *humioTimeout,
+		ResponseHeaderTimeout: *humioRespTimeout,
+		IdleConnTimeout:       *humioIdleTimeout,
+		MaxIdleConns:          *humioMaxIdle,
+		Gzip:                  *humioGzip,
+		GzipLevel:             *humioGzipLevel,
+		Protocol:              *humioProtocol,
+		Parser:                *humioParser,
 	}
 
 	humioClient := humio.NewHumioClient(humioConfig, logger)
 
+	routeConfigs, err := humio.ParseRoutes(*humioRoutes)
+	if err != nil {
+		logger.Fatal("invalid Humio routes", err)
+	}
+	var routes []nozzle.Route
+	for _, r := range routeConfigs {
+		routes = append(routes, nozzle.Route{
+			Name:   r.Name,
+			Match:  r.Match,
+			Client: humio.NewHumioClient(r.Config(humioConfig), logger),
+		})
+	}
+
+	eventOptions := &humio.EventOptions{
+		TimestampFormat:      *timestampFormat,
+		Location:             timestampLocation,
+		ParseJSONLogs:        *parseJSONLogs,
+		JSONPrefix:           *jsonLogPrefix,
+		JSONMaxDepth:         *jsonLogMaxDepth,
+		JSONMaxKeys:          *jsonLogMaxKeys,
+		ParseRTRLogs:         *parseRTRLogs,
+		SlowRequestThreshold: *slowRequest,
+	}
+
 	nozzleConfig := &nozzle.NozzleConfig{
 		HumioBatchTime:         5 * time.Second,
 		HumioMaxMsgNumPerBatch: 500,
+		EventSubscription:      eventSubscription,
+		MinReconnectDelay:      *minReconnectDelay,
+		MaxReconnectDelay:      *maxReconnectDelay,
+		MaxReconnectRetries:    *maxReconnects,
+		SpoolDir:               *spoolDir,
+		SpoolMaxBytes:          int64(*spoolMaxSize),
+		DrainTimeout:           *drainTimeout,
+		SenderWorkers:          *senderWorkers,
+		SenderQueueSize:        *senderQueueSize,
+		OverflowPolicy:         senderOverflowPolicy,
+		EventOptions:           eventOptions,
+		EnrichTimeout:          *enrichTimeout,
+		EnrichWorkers:          *enrichWorkers,
+		Multiline:              multilineConfig,
+		Tags:                   tagSelector,
+		TagsOnly:               *humioTagsOnly,
+		Routes:                 routes,
 	}
 
 	nozzleApp := nozzle.NewHumioNozzle(logger, firehoseClient, nozzleConfig, humioClient, cachingClient)
-	nozzleApp.Start()
+	if err := nozzleApp.Start(); err != nil {
+		logger.Error("nozzle stopped with an error", err)
+		os.Exit(1)
+	}
+}
+
+// defaultSyslogAddress listens on the port CF assigns to the app, so that the
+// receiver is reachable through its route.
+func defaultSyslogAddress() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func registerGoRoutineDumpSignalChannel() chan os.Signal {
@@ -1,19 +1,31 @@
 package mocks
 
 import (
+	"sync/atomic"
+
 	"github.com/humio/cloudfoundry2humio/caching"
 )
 
 type MockCaching struct {
-	MockGetAppInfo  func(string) caching.AppInfo
-	InstanceName    string
-	EnvironmentName string
+	MockGetAppInfo func(string) caching.AppInfo
+	// when nil, every app info is cached
+	MockGetCachedAppInfo func(string) (caching.AppInfo, bool)
+	InstanceName         string
+	EnvironmentName      string
+	stopped              int32
 }
 
 func (c *MockCaching) GetAppInfo(appGuid string) caching.AppInfo {
 	return c.MockGetAppInfo(appGuid)
 }
 
+func (c *MockCaching) GetCachedAppInfo(appGuid string) (caching.AppInfo, bool) {
+	if c.MockGetCachedAppInfo == nil {
+		return c.MockGetAppInfo(appGuid), true
+	}
+	return c.MockGetCachedAppInfo(appGuid)
+}
+
 func (c *MockCaching) GetInstanceName() string {
 	return c.InstanceName
 }
@@ -25,3 +37,12 @@ func (c *MockCaching) GetEnvironmentName() string {
 func (c *MockCaching) Initialize() {
 	return
 }
+
+func (c *MockCaching) Stop() {
+	atomic.StoreInt32(&c.stopped, 1)
+}
+
+// IsStopped reports whether the nozzle stopped the cache.
+func (c *MockCaching) IsStopped() bool {
+	return atomic.LoadInt32(&c.stopped) == 1
+}
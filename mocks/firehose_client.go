@@ -1,12 +1,16 @@
 package mocks
 
 import (
+	"sync"
+
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
 type MockFirehoseClient struct {
 	MessageChan chan *events.Envelope
 	ErrChan     chan error
+	connects    int
+	mutex       sync.Mutex
 }
 
 func NewMockFirehoseClient() *MockFirehoseClient {
@@ -17,9 +21,18 @@ func NewMockFirehoseClient() *MockFirehoseClient {
 }
 
 func (c *MockFirehoseClient) Connect() (<-chan *events.Envelope, <-chan error) {
+	c.mutex.Lock()
+	c.connects++
+	c.mutex.Unlock()
 	return c.MessageChan, c.ErrChan
 }
 
+func (c *MockFirehoseClient) GetConnectCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connects
+}
+
 func (c *MockFirehoseClient) CloseConsumer() error {
 	return nil
 }
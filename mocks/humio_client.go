@@ -1,28 +1,59 @@
 package mocks
 
-import "github.com/humio/cloudfoundry2humio/humio"
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/humio/cloudfoundry2humio/humio"
+)
 
 type MockHumioClient struct {
+	// when set, pushes and single logs block until a value is received
+	Release chan struct{}
+	// when set, pushes fail with it
+	Err       error
+	mutex     sync.Mutex
 	lastEvent string
+	pushes    int
 }
 
 func NewMockHumioClient() *MockHumioClient {
 	return &MockHumioClient{}
 }
 
-func (c *MockHumioClient) PushEvents(events *humio.Events) error {
-	payload, err := json.Marshal(*events)
+func (c *MockHumioClient) PushEvents(ctx context.Context, events []humio.Events) error {
+	if c.Release != nil {
+		<-c.Release
+	}
+	payload, err := json.Marshal(events)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if err == nil {
 		c.lastEvent = string(payload)
 	}
+	c.pushes++
+	if c.Err != nil {
+		return c.Err
+	}
 	return err
 }
 
-func (c *MockHumioClient) SingleLog(log string) error {
+func (c *MockHumioClient) SingleLog(ctx context.Context, log string) error {
+	if c.Release != nil {
+		<-c.Release
+	}
 	return nil
 }
 
 func (c *MockHumioClient) GetLastPushedEvents() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.lastEvent
 }
+
+func (c *MockHumioClient) GetPushCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pushes
+}
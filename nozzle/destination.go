@@ -0,0 +1,142 @@
+package nozzle
+
+import (
+	"path/filepath"
+	"sync/atomic"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/humio/cloudfoundry2humio/humio"
+	"github.com/humio/cloudfoundry2humio/spool"
+)
+
+// Route sends the events it matches to its own Humio client instead of the
+// nozzle's default client.
+type Route struct {
+	Name   string
+	Match  humio.RouteMatch
+	Client humio.HumioClient
+}
+
+// DestinationStats counts the events of a route.
+type DestinationStats struct {
+	SentEvents     uint64
+	FailedEvents   uint64
+	DroppedBatches uint64
+	DroppedEvents  uint64
+}
+
+// destination is where the events of a route go, with its own pending batch,
+// senders and spool so that a slow or unreachable Humio doesn't hold up the
+// other routes.
+type destination struct {
+	// accessed atomically, kept first for 64 bit alignment
+	sentEvents   uint64
+	failedEvents uint64
+
+	name        string
+	match       humio.RouteMatch
+	client      humio.HumioClient
+	nozzle      *HumioNozzle
+	pending     *humio.Batch
+	sender      *senderPool
+	spool       *spool.Spool
+	spoolNotify chan struct{}
+}
+
+func newDestination(o *HumioNozzle, name string, match humio.RouteMatch, client humio.HumioClient) *destination {
+	d := &destination{
+		name:        name,
+		match:       match,
+		client:      client,
+		nozzle:      o,
+		pending:     humio.NewBatch(),
+		spoolNotify: make(chan struct{}, 1),
+	}
+	config := o.nozzleConfig
+	d.sender = newSenderPool(config.SenderWorkers, config.SenderQueueSize, config.OverflowPolicy, d.sendEvents, o.logger)
+	d.sender.route = name
+	return d
+}
+
+// spoolDir keeps the default route's segments in the spool directory itself,
+// where earlier versions left them, and the others in a subdirectory.
+func (d *destination) spoolDir() string {
+	if d.name == humio.DefaultRoute {
+		return d.nozzle.nozzleConfig.SpoolDir
+	}
+	return filepath.Join(d.nozzle.nozzleConfig.SpoolDir, d.name)
+}
+
+// add appends the event to the pending batch and queues the batch once it's
+// full.
+func (d *destination) add(event *humio.Event) {
+	tags := d.nozzle.tags.Tags(event)
+	if d.nozzle.nozzleConfig.TagsOnly {
+		d.nozzle.tags.Untag(event)
+	}
+	d.pending.Add(tags, *event)
+
+	if d.pending.Len() >= d.nozzle.nozzleConfig.HumioMaxMsgNumPerBatch {
+		d.flush()
+	}
+}
+
+func (d *destination) flush() {
+	currentEvents := d.pending
+	d.pending = humio.NewBatch()
+
+	if d.spool != nil {
+		// spooled on the event loop, so that segments are in flush order
+		if currentEvents.Len() > 0 {
+			d.spoolEvents(currentEvents)
+		}
+		return
+	}
+	d.sender.submit(currentEvents)
+}
+
+func (d *destination) sendEvents(b *humio.Batch) {
+	if b.Len() == 0 {
+		return
+	}
+	d.push(b)
+}
+
+func (d *destination) push(b *humio.Batch) {
+	err := d.client.PushEvents(d.nozzle.ctx, b.Groups())
+	if err != nil {
+		atomic.AddUint64(&d.failedEvents, uint64(b.Len()))
+		d.nozzle.logger.Error("failed sending events to Humio", err, lager.Data{"route": d.name, "events": b.Len()})
+		return
+	}
+	atomic.AddUint64(&d.sentEvents, uint64(b.Len()))
+}
+
+func (d *destination) stats() DestinationStats {
+	return DestinationStats{
+		SentEvents:     atomic.LoadUint64(&d.sentEvents),
+		FailedEvents:   atomic.LoadUint64(&d.failedEvents),
+		DroppedBatches: atomic.LoadUint64(&d.sender.droppedBatches),
+		DroppedEvents:  atomic.LoadUint64(&d.sender.droppedEvents),
+	}
+}
+
+// Stats returns the counters of every route, including the default route.
+func (o *HumioNozzle) Stats() map[string]DestinationStats {
+	stats := make(map[string]DestinationStats, len(o.destinations))
+	for _, d := range o.destinations {
+		stats[d.name] = d.stats()
+	}
+	return stats
+}
+
+// route returns the destination of the first route matching the event,
+// falling back to the default route.
+func (o *HumioNozzle) route(event *humio.Event) *destination {
+	for _, d := range o.destinations[1:] {
+		if d.match.Matches(event) {
+			return d
+		}
+	}
+	return o.destinations[0]
+}
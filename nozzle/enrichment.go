@@ -0,0 +1,235 @@
+package nozzle
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/humio/cloudfoundry2humio/caching"
+	"github.com/humio/cloudfoundry2humio/humio"
+)
+
+const (
+	defaultEnrichTimeout = 2 * time.Second
+	defaultEnrichWorkers = 4
+	// app lookups waiting for a worker
+	enrichQueueSize = 1024
+	// envelopes held back across all apps waiting for their lookup
+	maxPendingEnvelopes = 10000
+)
+
+// cachedAppInfos maps envelopes with whatever the cache has, it never looks
+// up apps, so that mapping never waits for the Cloud Controller.
+type cachedAppInfos struct {
+	caching.CachingClient
+}
+
+func (c cachedAppInfos) GetAppInfo(appGuid string) caching.AppInfo {
+	appInfo, _ := c.GetCachedAppInfo(appGuid)
+	return appInfo
+}
+
+// pendingApp holds back the envelopes of an app until its app info has been
+// looked up, or the deadline passed.
+type pendingApp struct {
+	envelopes []*events.Envelope
+	deadline  time.Time
+}
+
+// enrichment looks up the app infos missing from the cache in the background.
+// The pending apps are only used from the nozzle's event loop.
+type enrichment struct {
+	// accessed atomically, kept first for 64 bit alignment
+	unenrichedEvents uint64
+
+	timeout time.Duration
+	workers int
+	lookups chan string
+	results chan string
+	pending map[string]*pendingApp
+	// held back envelopes across all pending apps
+	pendingEnvelopes int
+	// whether a route matches on the org, space or app of events, which
+	// end up on the default route when sent without app info
+	routedByApp bool
+}
+
+func newEnrichment(timeout time.Duration, workers int, routes []Route) *enrichment {
+	if timeout <= 0 {
+		timeout = defaultEnrichTimeout
+	}
+	if workers < 1 {
+		workers = defaultEnrichWorkers
+	}
+	en := &enrichment{
+		timeout: timeout,
+		workers: workers,
+		lookups: make(chan string, enrichQueueSize),
+		results: make(chan string, enrichQueueSize),
+		pending: make(map[string]*pendingApp),
+	}
+	for _, r := range routes {
+		if r.Match.Org != "" || r.Match.Space != "" || r.Match.App != "" {
+			en.routedByApp = true
+		}
+	}
+	return en
+}
+
+// startEnrichment starts the workers looking up app infos into the cache.
+func (o *HumioNozzle) startEnrichment() {
+	for i := 0; i < o.enrichment.workers; i++ {
+		go func() {
+			for {
+				var appGuid string
+				select {
+				case appGuid = <-o.enrichment.lookups:
+				case <-o.ctx.Done():
+					return
+				}
+				o.cachingClient.GetAppInfo(appGuid)
+				select {
+				case o.enrichment.results <- appGuid:
+				case <-o.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// addEnvelope maps the envelope to a Humio event and adds it to the batch of
+// its route. Envelopes of apps missing from the cache are held back until
+// their app info has been looked up, as long as there is room for them,
+// without ever waiting for a lookup.
+func (o *HumioNozzle) addEnvelope(e *events.Envelope) {
+	appGuid := humio.EnvelopeAppID(e)
+	if appGuid == "" {
+		o.mapEnvelope(e)
+		return
+	}
+
+	en := o.enrichment
+	if p, ok := en.pending[appGuid]; ok {
+		if en.pendingEnvelopes < maxPendingEnvelopes {
+			// keep the order of the app's envelopes
+			p.envelopes = append(p.envelopes, e)
+			en.pendingEnvelopes++
+			return
+		}
+		o.sendUnenriched(appGuid, "too many events waiting for app lookups", e)
+		return
+	}
+
+	if _, fresh := o.cachingClient.GetCachedAppInfo(appGuid); fresh {
+		o.mapEnvelope(e)
+		return
+	}
+
+	if en.pendingEnvelopes >= maxPendingEnvelopes {
+		o.sendUnenriched(appGuid, "too many events waiting for app lookups", e)
+		return
+	}
+	select {
+	case en.lookups <- appGuid:
+		en.pending[appGuid] = &pendingApp{
+			envelopes: []*events.Envelope{e},
+			deadline:  time.Now().Add(en.timeout),
+		}
+		en.pendingEnvelopes++
+	default:
+		o.sendUnenriched(appGuid, "too many app lookups", e)
+	}
+}
+
+// sendUnenriched maps envelopes with whatever app info the cache has. With
+// routes matching on app info they may end up on the default route, which is
+// worth an error.
+func (o *HumioNozzle) sendUnenriched(appGuid string, reason string, envelopes ...*events.Envelope) {
+	total := atomic.AddUint64(&o.enrichment.unenrichedEvents, uint64(len(envelopes)))
+	data := lager.Data{
+		"guid":                    appGuid,
+		"reason":                  reason,
+		"events":                  len(envelopes),
+		"total_unenriched_events": total,
+	}
+	if o.enrichment.routedByApp {
+		o.logger.Error("sending events without app info, they may go to the default route", nil, data)
+	} else {
+		o.logger.Debug("sending events without app info", data)
+	}
+	for _, e := range envelopes {
+		o.mapEnvelope(e)
+	}
+}
+
+// UnenrichedEvents is the number of events of apps missing from the cache
+// which were sent before their app was looked up.
+func (o *HumioNozzle) UnenrichedEvents() uint64 {
+	return atomic.LoadUint64(&o.enrichment.unenrichedEvents)
+}
+
+// releasePending maps the held back envelopes of an app once it has been
+// looked up.
+func (o *HumioNozzle) releasePending(appGuid string) {
+	p, ok := o.takePending(appGuid)
+	if !ok {
+		// released by the deadline already
+		return
+	}
+	for _, e := range p.envelopes {
+		o.mapEnvelope(e)
+	}
+}
+
+func (o *HumioNozzle) takePending(appGuid string) (*pendingApp, bool) {
+	p, ok := o.enrichment.pending[appGuid]
+	if !ok {
+		return nil, false
+	}
+	delete(o.enrichment.pending, appGuid)
+	o.enrichment.pendingEnvelopes -= len(p.envelopes)
+	return p, true
+}
+
+// expirePending releases the apps whose lookup didn't finish in time, their
+// envelopes are sent with the app info in the cache, if any.
+func (o *HumioNozzle) expirePending(now time.Time) {
+	for appGuid, p := range o.enrichment.pending {
+		if !now.Before(p.deadline) {
+			o.takePending(appGuid)
+			o.sendUnenriched(appGuid, "app lookup timed out", p.envelopes...)
+		}
+	}
+}
+
+// releaseAllPending waits for the lookups of the pending apps until their
+// deadline or until ctx is done, whichever comes first, and releases the
+// apps which are still pending then.
+func (o *HumioNozzle) releaseAllPending(ctx context.Context) {
+	ticker := time.NewTicker(o.enrichment.timeout / 4)
+	defer ticker.Stop()
+
+	for len(o.enrichment.pending) > 0 {
+		select {
+		case appGuid := <-o.enrichment.results:
+			o.releasePending(appGuid)
+		case now := <-ticker.C:
+			o.expirePending(now)
+		case <-ctx.Done():
+			for appGuid, p := range o.enrichment.pending {
+				o.takePending(appGuid)
+				o.sendUnenriched(appGuid, "stopping before the app was looked up", p.envelopes...)
+			}
+		}
+	}
+}
+
+func (o *HumioNozzle) mapEnvelope(e *events.Envelope) {
+	var humioEvent = humio.NewEvent(e, cachedAppInfos{o.cachingClient}, o.nozzleConfig.EventOptions)
+	if humioEvent != nil {
+		o.route(humioEvent).add(humioEvent)
+	}
+}
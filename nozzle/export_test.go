@@ -0,0 +1,18 @@
+package nozzle
+
+import (
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+func NewRLPGatewayClientWithTokenRefresher(tokenRefresher TokenRefresher, firehoseConfig *FirehoseConfig, logger lager.Logger) FirehoseClient {
+	return newRLPGatewayClient(tokenRefresher, firehoseConfig, false, logger)
+}
+
+func NewFirehoseClientWithTokenRefresher(tokenRefresher TokenRefresher, firehoseConfig *FirehoseConfig, logger lager.Logger) FirehoseClient {
+	c := NewFirehoseClient(&cfclient.Config{}, firehoseConfig, logger).(*client)
+	c.newTokenRefresher = func() (TokenRefresher, error) {
+		return tokenRefresher, nil
+	}
+	return c
+}
@@ -2,11 +2,15 @@ package nozzle
 
 import (
 	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/cloudfoundry/noaa/consumer"
+	noaaerrors "github.com/cloudfoundry/noaa/errors"
 	events "github.com/cloudfoundry/sonde-go/events"
 )
 
@@ -20,12 +24,113 @@ type client struct {
 	firehoseConfig *FirehoseConfig
 	logger         lager.Logger
 	consumer       *consumer.Consumer
+	consumerLock   sync.Mutex
+	// logs in for every connect, replaced in tests
+	newTokenRefresher func() (TokenRefresher, error)
 }
 
 type FirehoseConfig struct {
 	SubscriptionId       string
 	TrafficControllerUrl string
 	IdleTimeout          time.Duration
+	EventSubscription    *EventSubscription
+	RLPGatewayUrl        string
+	RLPSourceIDs         []string
+}
+
+// EventSubscription describes which envelope types the nozzle consumes. A nil
+// subscription, or one with All set, accepts every envelope type.
+type EventSubscription struct {
+	All   bool
+	Types map[events.Envelope_EventType]bool
+}
+
+var logEventTypes = []events.Envelope_EventType{
+	events.Envelope_LogMessage,
+}
+
+var metricEventTypes = []events.Envelope_EventType{
+	events.Envelope_ValueMetric,
+	events.Envelope_CounterEvent,
+	events.Envelope_ContainerMetric,
+}
+
+// ParseEventSubscription parses "all", "logs", "metrics" or a comma separated
+// list of envelope type names (e.g. "LogMessage,HttpStartStop").
+func ParseEventSubscription(s string) (*EventSubscription, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "all":
+		return &EventSubscription{All: true}, nil
+	case "logs":
+		return newEventSubscription(logEventTypes), nil
+	case "metrics":
+		return newEventSubscription(metricEventTypes), nil
+	}
+
+	var types []events.Envelope_EventType
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		value, ok := events.Envelope_EventType_value[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown envelope type: %s", name)
+		}
+		types = append(types, events.Envelope_EventType(value))
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("no envelope types in subscription: %s", s)
+	}
+	return newEventSubscription(types), nil
+}
+
+func newEventSubscription(types []events.Envelope_EventType) *EventSubscription {
+	sub := &EventSubscription{Types: make(map[events.Envelope_EventType]bool)}
+	for _, t := range types {
+		sub.Types[t] = true
+	}
+	return sub
+}
+
+// Accepts reports whether envelopes of the given type should be processed.
+func (s *EventSubscription) Accepts(t events.Envelope_EventType) bool {
+	if s == nil || s.All {
+		return true
+	}
+	return s.Types[t]
+}
+
+// filter returns the server side filter matching the subscription, if the
+// traffic controller supports one. Other subscriptions read the whole
+// firehose and rely on Accepts to drop unwanted envelopes.
+func (s *EventSubscription) filter() (consumer.EnvelopeFilter, bool) {
+	if s == nil || s.All {
+		return 0, false
+	}
+	if s.onlyContains(logEventTypes) {
+		return consumer.LogMessages, true
+	}
+	if s.onlyContains(metricEventTypes) {
+		return consumer.Metrics, true
+	}
+	return 0, false
+}
+
+func (s *EventSubscription) onlyContains(types []events.Envelope_EventType) bool {
+	for t := range s.Types {
+		found := false
+		for _, allowed := range types {
+			if t == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return len(s.Types) > 0
 }
 
 type CfClientTokenRefresh struct {
@@ -43,31 +148,94 @@ func (ct *CfClientTokenRefresh) RefreshAuthToken() (string, error) {
 }
 
 func NewFirehoseClient(cfClientConfig *cfclient.Config, firehoseConfig *FirehoseConfig, logger lager.Logger) FirehoseClient {
-	return &client{
+	c := &client{
 		cfClientConfig: cfClientConfig,
 		firehoseConfig: firehoseConfig,
 		logger:         logger,
 	}
+	c.newTokenRefresher = c.cfClientTokenRefresher
+	return c
 }
 
+func (c *client) cfClientTokenRefresher() (TokenRefresher, error) {
+	cfClient, err := cfclient.NewClient(c.cfClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &CfClientTokenRefresh{cfClient: cfClient, logger: c.logger}, nil
+}
+
+// Connect opens the firehose without the reconnects of the noaa consumer, the
+// nozzle reconnects with its own backoff when the firehose reports an error.
 func (c *client) Connect() (<-chan *events.Envelope, <-chan error) {
 	c.logger.Debug("connect", lager.Data{"dopplerAddress": c.firehoseConfig.TrafficControllerUrl})
-	cfClient, err := cfclient.NewClient(c.cfClientConfig)
+	refresher, err := c.newTokenRefresher()
 	if err != nil {
-		c.logger.Fatal("error creating cfclient", err)
+		// report through the error channel so the nozzle can retry
+		c.logger.Error("error creating cfclient", err)
+		errChan := make(chan error, 1)
+		errChan <- err
+		return nil, errChan
 	}
 
-	c.consumer = consumer.New(
+	current := consumer.New(
 		c.firehoseConfig.TrafficControllerUrl,
 		&tls.Config{InsecureSkipVerify: c.cfClientConfig.SkipSslValidation},
 		nil)
+	current.RefreshTokenFrom(refresher)
+	current.SetIdleTimeout(c.firehoseConfig.IdleTimeout)
+
+	c.consumerLock.Lock()
+	c.consumer = current
+	c.consumerLock.Unlock()
 
-	refresher := CfClientTokenRefresh{cfClient: cfClient, logger: c.logger}
-	c.consumer.RefreshTokenFrom(&refresher)
-	c.consumer.SetIdleTimeout(c.firehoseConfig.IdleTimeout)
-	return c.consumer.FilteredFirehose(c.firehoseConfig.SubscriptionId, "", consumer.LogMessages)
+	if filter, ok := c.firehoseConfig.EventSubscription.filter(); ok {
+		msgChan, errChan := current.FilteredFirehose(c.firehoseConfig.SubscriptionId, "", filter)
+		return msgChan, c.withoutReconnect(current, errChan)
+	}
+	return current.FirehoseWithoutReconnect(c.firehoseConfig.SubscriptionId, "")
+}
+
+// withoutReconnect closes the consumer of a filtered firehose, which noaa only
+// opens with reconnects, on its first error, and reports the error the
+// consumer would have retried.
+func (c *client) withoutReconnect(current *consumer.Consumer, errChan <-chan error) <-chan error {
+	firstErr := make(chan error, 1)
+	go func() {
+		defer close(firstErr)
+		err, ok := <-errChan
+		if !ok {
+			return
+		}
+		if retryErr, ok := err.(noaaerrors.RetryError); ok {
+			err = retryErr.Err
+		}
+		if closeErr := c.closeConsumer(current); closeErr != nil {
+			c.logger.Debug("error closing consumer", lager.Data{"error": closeErr.Error()})
+		}
+		firstErr <- err
+		// the firehose ends once its retry loop sees the closed connection
+		for range errChan {
+		}
+	}()
+	return firstErr
 }
 
 func (c *client) CloseConsumer() error {
-	return c.consumer.Close()
+	c.consumerLock.Lock()
+	current := c.consumer
+	c.consumerLock.Unlock()
+	return c.closeConsumer(current)
+}
+
+// closeConsumer closes the given consumer unless it has been closed already.
+func (c *client) closeConsumer(current *consumer.Consumer) error {
+	c.consumerLock.Lock()
+	if current == nil || c.consumer != current {
+		c.consumerLock.Unlock()
+		return nil
+	}
+	c.consumer = nil
+	c.consumerLock.Unlock()
+	return current.Close()
 }
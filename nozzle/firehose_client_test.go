@@ -0,0 +1,93 @@
+package nozzle_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/humio/cloudfoundry2humio/mocks"
+	"github.com/humio/cloudfoundry2humio/nozzle"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Event subscription", func() {
+
+	It("accepts every envelope type by default", func() {
+		sub, err := nozzle.ParseEventSubscription("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sub.Accepts(events.Envelope_HttpStartStop)).To(BeTrue())
+		Expect(sub.Accepts(events.Envelope_ContainerMetric)).To(BeTrue())
+	})
+
+	It("accepts only log messages for logs", func() {
+		sub, err := nozzle.ParseEventSubscription("logs")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sub.Accepts(events.Envelope_LogMessage)).To(BeTrue())
+		Expect(sub.Accepts(events.Envelope_HttpStartStop)).To(BeFalse())
+	})
+
+	It("parses an explicit set of envelope types", func() {
+		sub, err := nozzle.ParseEventSubscription("LogMessage, HttpStartStop")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sub.Accepts(events.Envelope_LogMessage)).To(BeTrue())
+		Expect(sub.Accepts(events.Envelope_HttpStartStop)).To(BeTrue())
+		Expect(sub.Accepts(events.Envelope_ValueMetric)).To(BeFalse())
+	})
+
+	It("rejects unknown envelope types", func() {
+		_, err := nozzle.ParseEventSubscription("LogMessage,Bogus")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Firehose client", func() {
+	var (
+		server   *httptest.Server
+		requests int32
+	)
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&requests, 0)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	connect := func(eventTypes string) <-chan error {
+		subscription, err := nozzle.ParseEventSubscription(eventTypes)
+		Expect(err).NotTo(HaveOccurred())
+		client := nozzle.NewFirehoseClientWithTokenRefresher(staticTokenRefresher("bearer token"), &nozzle.FirehoseConfig{
+			SubscriptionId:       "humio",
+			TrafficControllerUrl: "ws" + strings.TrimPrefix(server.URL, "http"),
+			EventSubscription:    subscription,
+		}, mocks.NewMockLogger())
+		_, errChan := client.Connect()
+		return errChan
+	}
+
+	for _, eventTypes := range []string{"all", "logs"} {
+		eventTypes := eventTypes
+
+		It("leaves reconnecting to the nozzle for "+eventTypes, func() {
+			errChan := connect(eventTypes)
+
+			var err error
+			Eventually(errChan).Should(Receive(&err))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Error dialing trafficcontroller server"))
+			Eventually(errChan, 2*time.Second).Should(BeClosed())
+			Consistently(func() int32 {
+				return atomic.LoadInt32(&requests)
+			}, time.Second).Should(Equal(int32(1)))
+		})
+	}
+})
@@ -0,0 +1,139 @@
+package nozzle
+
+import (
+	"bytes"
+	"regexp"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+const (
+	defaultMultilineMaxLines     = 100
+	defaultMultilineFlushTimeout = time.Second
+)
+
+// defaultMultilineStartPattern starts a record at every line which isn't
+// indented, such as the first line of a stack trace.
+var defaultMultilineStartPattern = regexp.MustCompile(`^\S`)
+
+// MultilineConfig joins log lines which don't match StartPattern, such as
+// the lines of a stack trace, to the log message before them.
+type MultilineConfig struct {
+	// StartPattern matches the first line of a log record, nil matches lines
+	// which aren't indented
+	StartPattern *regexp.Regexp
+	// a record is sent once it has MaxLines lines, or when no line was added
+	// to it for FlushTimeout
+	MaxLines     int
+	FlushTimeout time.Duration
+}
+
+// multilineKey identifies the stream of log lines of an app instance.
+type multilineKey struct {
+	appID          string
+	sourceType     string
+	sourceInstance string
+}
+
+type multilineRecord struct {
+	envelope *events.Envelope
+	lines    [][]byte
+	updated  time.Time
+}
+
+// multilineAggregator reassembles multiline log records per app instance.
+// It's only used from the nozzle's event loop.
+type multilineAggregator struct {
+	config  MultilineConfig
+	records map[multilineKey]*multilineRecord
+}
+
+func newMultilineAggregator(config MultilineConfig) *multilineAggregator {
+	if config.StartPattern == nil {
+		config.StartPattern = defaultMultilineStartPattern
+	}
+	if config.MaxLines < 1 {
+		config.MaxLines = defaultMultilineMaxLines
+	}
+	if config.FlushTimeout <= 0 {
+		config.FlushTimeout = defaultMultilineFlushTimeout
+	}
+	return &multilineAggregator{
+		config:  config,
+		records: make(map[multilineKey]*multilineRecord),
+	}
+}
+
+// add returns the envelopes which are complete, including envelopes which
+// aren't app log messages straight away.
+func (m *multilineAggregator) add(e *events.Envelope, now time.Time) []*events.Envelope {
+	logMessage := e.GetLogMessage()
+	if e.GetEventType() != events.Envelope_LogMessage || logMessage.GetAppId() == "" {
+		return []*events.Envelope{e}
+	}
+
+	key := multilineKey{
+		appID:          logMessage.GetAppId(),
+		sourceType:     logMessage.GetSourceType(),
+		sourceInstance: logMessage.GetSourceInstance(),
+	}
+	line := logMessage.GetMessage()
+
+	var complete []*events.Envelope
+	record, ok := m.records[key]
+	if ok && !m.config.StartPattern.Match(line) {
+		record.lines = append(record.lines, line)
+		record.updated = now
+		if len(record.lines) < m.config.MaxLines {
+			return nil
+		}
+		delete(m.records, key)
+		return append(complete, record.join())
+	}
+
+	if ok {
+		delete(m.records, key)
+		complete = append(complete, record.join())
+	}
+	m.records[key] = &multilineRecord{
+		envelope: e,
+		lines:    [][]byte{line},
+		updated:  now,
+	}
+	return complete
+}
+
+// expire returns the records which were not added to for the flush timeout.
+func (m *multilineAggregator) expire(now time.Time) []*events.Envelope {
+	var complete []*events.Envelope
+	for key, record := range m.records {
+		if now.Sub(record.updated) >= m.config.FlushTimeout {
+			delete(m.records, key)
+			complete = append(complete, record.join())
+		}
+	}
+	return complete
+}
+
+// flush returns all pending records.
+func (m *multilineAggregator) flush() []*events.Envelope {
+	var complete []*events.Envelope
+	for key, record := range m.records {
+		delete(m.records, key)
+		complete = append(complete, record.join())
+	}
+	return complete
+}
+
+// join returns the envelope of the record's first line with the message of
+// all lines.
+func (r *multilineRecord) join() *events.Envelope {
+	if len(r.lines) == 1 {
+		return r.envelope
+	}
+	e := proto.Clone(r.envelope).(*events.Envelope)
+	e.LogMessage.Message = bytes.Join(r.lines, []byte("\n"))
+	return e
+}
@@ -1,9 +1,10 @@
 package nozzle
 
 import (
+	"context"
+	"errors"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
@@ -11,8 +12,12 @@ import (
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/humio/cloudfoundry2humio/caching"
 	"github.com/humio/cloudfoundry2humio/humio"
+	"github.com/humio/cloudfoundry2humio/spool"
 )
 
+// slowConsumerAlertTimeout bounds the retries of the slow consumer alert.
+const slowConsumerAlertTimeout = 10 * time.Second
+
 type HumioNozzle struct {
 	logger         lager.Logger
 	errChan        <-chan error
@@ -22,15 +27,55 @@ type HumioNozzle struct {
 	nozzleConfig   *NozzleConfig
 	humioClient    humio.HumioClient
 	cachingClient  caching.CachingClient
+	// the default route first, then the configured routes in order
+	destinations []*destination
+	// nil unless multiline log records are reassembled
+	multiline *multilineAggregator
+	// attributes used as Humio tags, the configured ones or the defaults
+	tags humio.TagSelector
+	// app info lookups off the event loop
+	enrichment *enrichment
+	// cancels in-flight Humio requests once the drain timeout is exceeded
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 type NozzleConfig struct {
 	HumioBatchTime         time.Duration
 	HumioMaxMsgNumPerBatch int
+	EventSubscription      *EventSubscription
+	// firehose reconnection policy, a MaxReconnectRetries of 0 retries forever
+	MinReconnectDelay   time.Duration
+	MaxReconnectDelay   time.Duration
+	MaxReconnectRetries int
+	// optional on-disk spool keeping batches until Humio accepted them
+	SpoolDir      string
+	SpoolMaxBytes int64
+	// time allowed on shutdown to flush pending and in-flight batches
+	DrainTimeout time.Duration
+	// bounded pool of Humio senders
+	SenderWorkers   int
+	SenderQueueSize int
+	OverflowPolicy  OverflowPolicy
+	// mapping of envelopes to Humio events, nil uses the defaults
+	EventOptions *humio.EventOptions
+	// time events wait for their app info to be looked up, and the number
+	// of concurrent lookups
+	EnrichTimeout time.Duration
+	EnrichWorkers int
+	// optional reassembly of multiline log records
+	Multiline *MultilineConfig
+	// attributes used as Humio tags, nil uses humio.DefaultTags, and whether
+	// they are left out of the event attributes
+	Tags     humio.TagSelector
+	TagsOnly bool
+	// routes taking events away from the default Humio client, the first
+	// matching route wins
+	Routes []Route
 }
 
 func NewHumioNozzle(logger lager.Logger, firehoseClient FirehoseClient, nozzleConfig *NozzleConfig, humioClient humio.HumioClient, caching caching.CachingClient) *HumioNozzle {
-	return &HumioNozzle{
+	o := &HumioNozzle{
 		logger:         logger,
 		errChan:        make(<-chan error),
 		msgChan:        make(<-chan *events.Envelope),
@@ -39,14 +84,50 @@ func NewHumioNozzle(logger lager.Logger, firehoseClient FirehoseClient, nozzleCo
 		nozzleConfig:   nozzleConfig,
 		humioClient:    humioClient,
 		cachingClient:  caching,
+		tags:           nozzleConfig.Tags,
+	}
+	if o.tags == nil {
+		o.tags = humio.DefaultTags
+	}
+	o.ctx, o.cancel = context.WithCancel(context.Background())
+	o.destinations = append(o.destinations, newDestination(o, humio.DefaultRoute, humio.RouteMatch{}, humioClient))
+	for _, r := range nozzleConfig.Routes {
+		o.destinations = append(o.destinations, newDestination(o, r.Name, r.Match, r.Client))
+	}
+	o.enrichment = newEnrichment(nozzleConfig.EnrichTimeout, nozzleConfig.EnrichWorkers, nozzleConfig.Routes)
+	if nozzleConfig.Multiline != nil {
+		o.multiline = newMultilineAggregator(*nozzleConfig.Multiline)
 	}
+	return o
 }
 
 func (o *HumioNozzle) Start() error {
 	o.cachingClient.Initialize()
+	defer o.cachingClient.Stop()
+
+	if o.nozzleConfig.SpoolDir != "" {
+		for _, d := range o.destinations {
+			s, err := spool.NewSpool(d.spoolDir(), o.nozzleConfig.SpoolMaxBytes, o.logger)
+			if err != nil {
+				o.logger.Error("failed opening spool", err, lager.Data{"dir": d.spoolDir()})
+				// stops the drainers of the spools opened already
+				o.cancel()
+				return err
+			}
+			d.spool = s
+			// replays batches left over from a previous run straight away
+			go d.drainSpool()
+		}
+	}
+
+	for _, d := range o.destinations {
+		d.sender.start()
+	}
+	o.startEnrichment()
 
 	// termination signal from CF for proper lifecycle
 	signal.Notify(o.signalChan, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(o.signalChan)
 
 	o.msgChan, o.errChan = o.firehoseClient.Connect()
 
@@ -55,81 +136,194 @@ func (o *HumioNozzle) Start() error {
 }
 
 func (o *HumioNozzle) routeEvents() error {
-	pendingEvents := make([]humio.Events, 0)
+	var reconnectChan <-chan time.Time
+	reconnectAttempts := 0
+	authFailures := 0
 
 	ticker := time.NewTicker(o.nozzleConfig.HumioBatchTime)
+
+	enrichmentTicker := time.NewTicker(o.enrichment.timeout / 4)
+	defer enrichmentTicker.Stop()
+
+	var multilineChan <-chan time.Time
+	if o.multiline != nil {
+		multilineTicker := time.NewTicker(o.multiline.config.FlushTimeout / 2)
+		defer multilineTicker.Stop()
+		multilineChan = multilineTicker.C
+	}
+
 	for {
 		select {
 		case s := <-o.signalChan:
 			o.logger.Info("exiting nozzle", lager.Data{"signal": s.String()})
+			// stop reading before flushing what was already read
 			err := o.firehoseClient.CloseConsumer()
 			if err != nil {
 				o.logger.Error("error closing consumer", err)
 			}
-			os.Exit(1)
+			ticker.Stop()
+			return o.shutdown()
 		case <-ticker.C:
-			currentEvents := pendingEvents
-			pendingEvents = make([]humio.Events, 0)
-			go o.sendEvents(&currentEvents)
-		case msg := <-o.msgChan:
-			var humioEvent = humio.NewEvent(msg, o.cachingClient)
-			if humioEvent != nil {
-				var events = &humio.Events{
-					Events: []humio.Event{*humioEvent},
-					Tags: humio.Tags{
-						AppID:     humioEvent.Attributes.App.ID,
-						SpaceID:   humioEvent.Attributes.Space.ID,
-						OrgID:     humioEvent.Attributes.Org.ID,
-					},
-				}
+			for _, d := range o.destinations {
+				d.flush()
+			}
+		case now := <-multilineChan:
+			for _, e := range o.multiline.expire(now) {
+				o.addEnvelope(e)
+			}
+		case appGuid := <-o.enrichment.results:
+			o.releasePending(appGuid)
+		case now := <-enrichmentTicker.C:
+			o.expirePending(now)
+		case <-reconnectChan:
+			reconnectChan = nil
+			o.logger.Info("reconnecting to the firehose", lager.Data{"attempt": reconnectAttempts})
+			o.msgChan, o.errChan = o.firehoseClient.Connect()
+		case msg, ok := <-o.msgChan:
+			if !ok {
+				o.msgChan = nil
+				continue
+			}
+			// the connection is healthy again once envelopes flow
+			reconnectAttempts = 0
+			authFailures = 0
 
-				pendingEvents = append(pendingEvents, *events)
-				doPost := false
-				if len(pendingEvents) >= o.nozzleConfig.HumioMaxMsgNumPerBatch {
-					doPost = true
-					break
-				}
-				if doPost {
-					currentEvents := pendingEvents
-					pendingEvents = make([]humio.Events, 0)
-					go o.sendEvents(&currentEvents)
-				}
+			if !o.nozzleConfig.EventSubscription.Accepts(msg.GetEventType()) {
+				continue
+			}
+			if o.multiline == nil {
+				o.addEnvelope(msg)
+				continue
+			}
+			for _, e := range o.multiline.add(msg, time.Now()) {
+				o.addEnvelope(e)
+			}
+		case err, ok := <-o.errChan:
+			if !ok {
+				o.errChan = nil
+				continue
 			}
-		case err := <-o.errChan:
 			o.logger.Error("Error while reading from the firehose", err)
 
-			if strings.Contains(err.Error(), "close 1008 (policy violation)") {
+			o.logger.Info("Closing connection with traffic controller")
+			if err := o.firehoseClient.CloseConsumer(); err != nil {
+				o.logger.Error("error closing consumer", err)
+			}
+			// pending events stay buffered while the nozzle reconnects
+			o.msgChan, o.errChan = nil, nil
+
+			var delay time.Duration
+			switch classifyDisconnect(err) {
+			case disconnectSlowConsumer:
 				o.logger.Error("Disconnected because nozzle couldn't keep up. Please try scaling up the nozzle.", nil)
 				o.logSlowConsumerAlert()
+				// the traffic controller dropped a healthy connection, so
+				// reconnect straight away without consuming a retry
+				reconnectAttempts = 0
+			case disconnectUnauthorized:
+				authFailures++
+				o.logger.Error("Firehose authentication failed, please check the firehose user credentials and doppler.firehose scope", err,
+					lager.Data{"failures": authFailures})
+				if authFailures >= maxAuthFailures {
+					o.shutdown()
+					return err
+				}
+				delay = o.nozzleConfig.MaxReconnectDelay
+			default:
+				reconnectAttempts++
+				if o.nozzleConfig.MaxReconnectRetries > 0 && reconnectAttempts > o.nozzleConfig.MaxReconnectRetries {
+					o.logger.Error("Giving up reconnecting to the firehose", err,
+						lager.Data{"retries": o.nozzleConfig.MaxReconnectRetries})
+					o.shutdown()
+					return err
+				}
+				delay = backoff(reconnectAttempts, o.nozzleConfig.MinReconnectDelay, o.nozzleConfig.MaxReconnectDelay)
 			}
 
-			go o.sendEvents(&pendingEvents)
-
-			o.logger.Error("Closing connection with traffic controller", nil)
-			o.firehoseClient.CloseConsumer()
-			return err
+			o.logger.Info("scheduling firehose reconnect", lager.Data{"delay": delay.String()})
+			reconnectChan = time.After(delay)
 		}
 	}
 }
 
-func (o *HumioNozzle) sendEvents(e *[]humio.Events) {
-	if len(*e) == 0 {
-		return
-	}
+// Stop shuts the nozzle down the same way a SIGTERM does.
+func (o *HumioNozzle) Stop() {
+	o.signalChan <- syscall.SIGTERM
+}
 
-	for _, ev := range *e {
-		var err = o.humioClient.PushEvents(&ev)
+// shutdown flushes the pending batches and waits for the senders of every
+// route to finish within the drain timeout. It returns an error when batches
+// may have been lost.
+func (o *HumioNozzle) shutdown() error {
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), o.nozzleConfig.DrainTimeout)
+	defer cancelDrain()
 
-		if err != nil {
-			o.logger.Error("failed sending events to Humio", err)
+	if o.multiline != nil {
+		for _, e := range o.multiline.flush() {
+			o.addEnvelope(e)
+		}
+	}
+	o.releaseAllPending(drainCtx)
+	for _, d := range o.destinations {
+		if d.spool != nil {
+			// the spool drainer sends it after the batches spooled before
+			d.flush()
 		}
 	}
+
+	pending := 0
+	for _, d := range o.destinations {
+		pending += d.pending.Len()
+	}
+	o.logger.Info("draining pending events", lager.Data{
+		"events":  pending,
+		"timeout": o.nozzleConfig.DrainTimeout.String(),
+	})
+
+	defer o.cancel()
+
+	drained := make(chan bool, len(o.destinations))
+	for _, d := range o.destinations {
+		go func(d *destination) {
+			drained <- d.sender.drain(drainCtx, d.pending)
+		}(d)
+	}
+	ok := true
+	for range o.destinations {
+		ok = <-drained && ok
+	}
+
+	for _, d := range o.destinations {
+		stats := d.stats()
+		o.logger.Info("route stats", lager.Data{
+			"route":           d.name,
+			"sent_events":     stats.SentEvents,
+			"failed_events":   stats.FailedEvents,
+			"dropped_batches": stats.DroppedBatches,
+			"dropped_events":  stats.DroppedEvents,
+		})
+	}
+
+	if !ok {
+		err := errors.New("drain timeout exceeded")
+		o.logger.Error("failed flushing pending events before exiting", err)
+		return err
+	}
+
+	o.logger.Info("nozzle stopped")
+	return nil
 }
 
+// logSlowConsumerAlert sends the alert in the background, so that a slow or
+// unreachable Humio doesn't hold up the reconnect.
 func (o *HumioNozzle) logSlowConsumerAlert() {
-	err := o.humioClient.SingleLog("Humio nozzle is too slow to consume events")
+	go func() {
+		ctx, cancel := context.WithTimeout(o.ctx, slowConsumerAlertTimeout)
+		defer cancel()
 
-	if err != nil {
-		o.logger.Error("failed sending single log to Humio", err)
-	}
+		err := o.humioClient.SingleLog(ctx, "Humio nozzle is too slow to consume events")
+		if err != nil {
+			o.logger.Error("failed sending single log to Humio", err)
+		}
+	}()
 }
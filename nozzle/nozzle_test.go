@@ -1,11 +1,20 @@
 package nozzle_test
 
 import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
 	"time"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/humio/cloudfoundry2humio/caching"
+	"github.com/humio/cloudfoundry2humio/humio"
 	"github.com/humio/cloudfoundry2humio/mocks"
 	"github.com/humio/cloudfoundry2humio/nozzle"
+	"github.com/humio/cloudfoundry2humio/spool"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -20,6 +29,69 @@ var (
 )
 
 var _ = Describe("Humio nozzle", func() {
+	var (
+		running []*nozzle.HumioNozzle
+		exited  []chan error
+	)
+
+	// run starts the nozzle, it's stopped once the spec is done
+	run := func(n *nozzle.HumioNozzle) {
+		done := make(chan error, 1)
+		running = append(running, n)
+		exited = append(exited, done)
+		go func() {
+			done <- n.Start()
+		}()
+	}
+
+	AfterEach(func() {
+		for i, n := range running {
+			n.Stop()
+			Eventually(exited[i], 5*time.Second).Should(Receive())
+		}
+		running, exited = nil, nil
+	})
+
+	// newNozzle creates a nozzle with its own firehose and Humio client
+	newNozzle := func(config *nozzle.NozzleConfig) (*nozzle.HumioNozzle, *mocks.MockFirehoseClient, *mocks.MockHumioClient) {
+		f := mocks.NewMockFirehoseClient()
+		h := mocks.NewMockHumioClient()
+		return nozzle.NewHumioNozzle(logger, f, config, h, cachingClient), f, h
+	}
+
+	// logEnvelope is a LogMessage of the app, or of the platform when appID
+	// is empty
+	logEnvelope := func(appID string, message string) *events.Envelope {
+		eventType := events.Envelope_LogMessage
+		messageType := events.LogMessage_OUT
+		e := &events.Envelope{
+			EventType: &eventType,
+			LogMessage: &events.LogMessage{
+				MessageType: &messageType,
+				Message:     []byte(message),
+			},
+		}
+		if appID != "" {
+			e.LogMessage.AppId = &appID
+		}
+		return e
+	}
+
+	// pushed decodes the last batch the client pushed
+	pushed := func(c *mocks.MockHumioClient) []humio.Events {
+		var payload []humio.Events
+		json.Unmarshal([]byte(c.GetLastPushedEvents()), &payload)
+		return payload
+	}
+
+	// lastEvent is the first event of the last batch the client pushed
+	lastEvent := func(c *mocks.MockHumioClient) humio.Event {
+		payload := pushed(c)
+		if len(payload) == 0 || len(payload[0].Events) == 0 {
+			return humio.Event{}
+		}
+		return payload[0].Events[0]
+	}
 
 	BeforeEach(func() {
 		firehoseClient = mocks.NewMockFirehoseClient()
@@ -31,11 +103,14 @@ var _ = Describe("Humio nozzle", func() {
 		nozzleConfig = &nozzle.NozzleConfig{
 			HumioBatchTime:         5 * time.Millisecond,
 			HumioMaxMsgNumPerBatch: 1,
+			MinReconnectDelay:      time.Millisecond,
+			MaxReconnectDelay:      5 * time.Millisecond,
+			MaxReconnectRetries:    3,
 		}
 		humioClient = mocks.NewMockHumioClient()
 
 		humioNozzle = nozzle.NewHumioNozzle(logger, firehoseClient, nozzleConfig, humioClient, cachingClient)
-		go humioNozzle.Start()
+		run(humioNozzle)
 	})
 
 	It("routes a LogMessage", func() {
@@ -57,7 +132,7 @@ var _ = Describe("Humio nozzle", func() {
 
 		firehoseClient.MessageChan <- envelope
 
-		msgJson := `{"tags":{},"events":[{"timestamp":"1970-01-01T01:00:00+01:00","attributes":{"eventtype":"LogMessage","timestamp":"1970-01-01T01:00:00+01:00","deployment":"","env":"dev","job":"","index":"","instance":"nozzle0","org":{},"space":{},"app":{},"http":{"starttimestamp":"","stoptimestamp":"","requestid":"","peertype":"","method":"","uri":"","remoteaddr":"","ua":"","statuscode":0,"contentlength":0,"instanceindex":0,"instanceid":"","forwarded":""},"log":{"message":"","messagetype":"OUT","timestamp":"1970-01-01T01:00:01+01:00","sourcetype":"","sourceinst":"","sourcetypekey":"-OUT"}}}]}`
+		msgJson := `[{"tags":{},"events":[{"timestamp":"1970-01-01T01:00:00+01:00","attributes":{"eventtype":"LogMessage","timestamp":"1970-01-01T01:00:00+01:00","deployment":"","env":"dev","job":"","index":"","instance":"nozzle0","org":{},"space":{},"app":{},"http":{"starttimestamp":"","stoptimestamp":"","requestid":"","peertype":"","method":"","uri":"","remoteaddr":"","ua":"","statuscode":0,"contentlength":0,"instanceindex":0,"instanceid":"","forwarded":""},"log":{"message":"","messagetype":"OUT","timestamp":"1970-01-01T01:00:01+01:00","sourcetype":"","sourceinst":"","sourcetypekey":"-OUT"}}}]}]`
 		Eventually(func() string {
 			return humioClient.GetLastPushedEvents()
 		}).Should(Equal(msgJson))
@@ -86,9 +161,502 @@ var _ = Describe("Humio nozzle", func() {
 
 		firehoseClient.MessageChan <- envelope
 
-		msgJson := `{"tags":{},"events":[{"timestamp":"1970-01-01T01:00:00+01:00","attributes":{"eventtype":"HttpStartStop","timestamp":"1970-01-01T01:00:00+01:00","deployment":"","env":"dev","job":"","index":"","instance":"nozzle0","org":{},"space":{},"app":{},"http":{"starttimestamp":"1970-01-01T01:00:01+01:00","stoptimestamp":"1970-01-01T01:00:02+01:00","requestid":"","peertype":"Client","method":"GET","uri":"","remoteaddr":"","ua":"","statuscode":0,"contentlength":0,"instanceindex":0,"instanceid":"","forwarded":""},"log":{"message":"","messagetype":"","timestamp":"","sourcetype":"","sourceinst":"","sourcetypekey":""}}}]}`
+		msgJson := `[{"tags":{},"events":[{"timestamp":"1970-01-01T01:00:00+01:00","attributes":{"eventtype":"HttpStartStop","timestamp":"1970-01-01T01:00:00+01:00","deployment":"","env":"dev","job":"","index":"","instance":"nozzle0","org":{},"space":{},"app":{},"http":{"starttimestamp":"1970-01-01T01:00:01+01:00","stoptimestamp":"1970-01-01T01:00:02+01:00","requestid":"","peertype":"Client","method":"GET","uri":"","remoteaddr":"","ua":"","statuscode":0,"contentlength":0,"instanceindex":0,"instanceid":"","forwarded":"","duration_ns":1000000000,"duration_ms":1000},"log":{"message":"","messagetype":"","timestamp":"","sourcetype":"","sourceinst":"","sourcetypekey":""}}}]}]`
 		Eventually(func() string {
 			return humioClient.GetLastPushedEvents()
 		}).Should(Equal(msgJson))
 	})
+
+	It("routes a ContainerMetric with app info", func() {
+		cachingClient.MockGetAppInfo = func(appGuid string) caching.AppInfo {
+			return caching.AppInfo{
+				Name:    "myapp",
+				Org:     "myorg",
+				OrgID:   "org-guid",
+				Space:   "myspace",
+				SpaceID: "space-guid",
+			}
+		}
+
+		eventType := events.Envelope_ContainerMetric
+		appID := "app-guid"
+		var instanceIndex int32 = 1
+		cpuPercentage := 12.5
+		var memoryBytes uint64 = 1024
+		var diskBytes uint64 = 2048
+
+		containerMetric := events.ContainerMetric{
+			ApplicationId: &appID,
+			InstanceIndex: &instanceIndex,
+			CpuPercentage: &cpuPercentage,
+			MemoryBytes:   &memoryBytes,
+			DiskBytes:     &diskBytes,
+		}
+
+		envelope := &events.Envelope{
+			EventType:       &eventType,
+			ContainerMetric: &containerMetric,
+		}
+
+		firehoseClient.MessageChan <- envelope
+
+		msgJson := `[{"tags":{"appid":"app-guid","orgid":"org-guid","spaceid":"space-guid"},"events":[{"timestamp":"1970-01-01T01:00:00+01:00","attributes":{"eventtype":"ContainerMetric","timestamp":"1970-01-01T01:00:00+01:00","deployment":"","env":"dev","job":"","index":"","instance":"nozzle0","org":{"id":"org-guid","name":"myorg"},"space":{"id":"space-guid","name":"myspace"},"app":{"id":"app-guid","name":"myapp"},"http":{"starttimestamp":"","stoptimestamp":"","requestid":"","peertype":"","method":"","uri":"","remoteaddr":"","ua":"","statuscode":0,"contentlength":0,"instanceindex":0,"instanceid":"","forwarded":""},"log":{"message":"","messagetype":"","timestamp":"","sourcetype":"","sourceinst":"","sourcetypekey":""},"container":{"instanceindex":1,"cpupercentage":12.5,"memorybytes":1024,"diskbytes":2048,"memorybytesquota":0,"diskbytesquota":0}}}]}]`
+		Eventually(func() string {
+			return humioClient.GetLastPushedEvents()
+		}).Should(Equal(msgJson))
+	})
+
+	It("routes an Error", func() {
+		eventType := events.Envelope_Error
+		source := "doppler"
+		var code int32 = 500
+		message := "something went wrong"
+
+		errorEvent := events.Error{
+			Source:  &source,
+			Code:    &code,
+			Message: &message,
+		}
+
+		envelope := &events.Envelope{
+			EventType: &eventType,
+			Error:     &errorEvent,
+		}
+
+		firehoseClient.MessageChan <- envelope
+
+		msgJson := `[{"tags":{},"events":[{"timestamp":"1970-01-01T01:00:00+01:00","attributes":{"eventtype":"Error","timestamp":"1970-01-01T01:00:00+01:00","deployment":"","env":"dev","job":"","index":"","instance":"nozzle0","org":{},"space":{},"app":{},"http":{"starttimestamp":"","stoptimestamp":"","requestid":"","peertype":"","method":"","uri":"","remoteaddr":"","ua":"","statuscode":0,"contentlength":0,"instanceindex":0,"instanceid":"","forwarded":""},"log":{"message":"","messagetype":"","timestamp":"","sourcetype":"","sourceinst":"","sourcetypekey":""},"error":{"source":"doppler","code":500,"message":"something went wrong"}}}]}]`
+		Eventually(func() string {
+			return humioClient.GetLastPushedEvents()
+		}).Should(Equal(msgJson))
+	})
+
+	It("reconnects to the firehose after an error", func() {
+		Eventually(firehoseClient.GetConnectCount).Should(Equal(1))
+
+		firehoseClient.ErrChan <- errors.New("connection reset by peer")
+
+		Eventually(firehoseClient.GetConnectCount).Should(Equal(2))
+	})
+
+	It("reconnects and alerts when disconnected as a slow consumer", func() {
+		Eventually(firehoseClient.GetConnectCount).Should(Equal(1))
+
+		firehoseClient.ErrChan <- errors.New("websocket: close 1008 (policy violation): Client did not respond to ping before keep-alive timeout expired.")
+
+		Eventually(firehoseClient.GetConnectCount).Should(Equal(2))
+		var actions []string
+		for _, log := range logger.GetLogs(lager.ERROR) {
+			actions = append(actions, log.Action)
+		}
+		Expect(actions).To(ContainElement("Disconnected because nozzle couldn't keep up. Please try scaling up the nozzle."))
+	})
+
+	It("reconnects while the slow consumer alert is sent", func() {
+		alertNozzle, alertFirehoseClient, alertHumioClient := newNozzle(nozzleConfig)
+		alertHumioClient.Release = make(chan struct{})
+		defer close(alertHumioClient.Release)
+		run(alertNozzle)
+		Eventually(alertFirehoseClient.GetConnectCount).Should(Equal(1))
+
+		alertFirehoseClient.ErrChan <- errors.New("websocket: close 1008 (policy violation): Client did not respond to ping before keep-alive timeout expired.")
+
+		Eventually(alertFirehoseClient.GetConnectCount).Should(Equal(2))
+	})
+
+	It("posts a batch as a single request grouped by tags", func() {
+		batchNozzle, batchFirehoseClient, batchHumioClient := newNozzle(&nozzle.NozzleConfig{
+			HumioBatchTime:         time.Hour,
+			HumioMaxMsgNumPerBatch: 3,
+		})
+		run(batchNozzle)
+
+		cachingClient.MockGetAppInfo = func(appGuid string) caching.AppInfo {
+			return caching.AppInfo{}
+		}
+
+		for _, appID := range []string{"app1", "app2", "app1"} {
+			batchFirehoseClient.MessageChan <- logEnvelope(appID, "")
+		}
+
+		Eventually(batchHumioClient.GetPushCount).Should(Equal(1))
+		payload := pushed(batchHumioClient)
+		Expect(payload).To(HaveLen(2))
+		Expect(payload[0].Tags["appid"]).To(Equal("app1"))
+		Expect(payload[0].Events).To(HaveLen(2))
+		Expect(payload[1].Tags["appid"]).To(Equal("app2"))
+		Expect(payload[1].Events).To(HaveLen(1))
+	})
+
+	It("sends tagged attributes only as tags", func() {
+		config := &nozzle.NozzleConfig{
+			HumioBatchTime:         time.Hour,
+			HumioMaxMsgNumPerBatch: 1,
+			TagsOnly:               true,
+		}
+		tagsNozzle, tagsFirehoseClient, tagsHumioClient := newNozzle(config)
+		run(tagsNozzle)
+
+		cachingClient.MockGetAppInfo = func(appGuid string) caching.AppInfo {
+			return caching.AppInfo{}
+		}
+		tagsFirehoseClient.MessageChan <- logEnvelope("app1", "")
+
+		Eventually(tagsHumioClient.GetPushCount).Should(Equal(1))
+		payload := pushed(tagsHumioClient)
+		Expect(payload[0].Tags).To(Equal(humio.Tags{"appid": "app1"}))
+		Expect(payload[0].Events[0].Attributes.App.ID).To(BeEmpty())
+		Expect(config.Tags).To(BeNil())
+	})
+
+	It("replays spooled batches on start", func() {
+		dir, err := ioutil.TempDir("", "spool")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		s, err := spool.NewSpool(dir, 0, logger)
+		Expect(err).NotTo(HaveOccurred())
+		s.Write([]byte(`[{"tags":{"appid":"spooled"},"events":[]}]`))
+
+		spoolNozzle, _, spoolHumioClient := newNozzle(&nozzle.NozzleConfig{
+			HumioBatchTime:         time.Hour,
+			HumioMaxMsgNumPerBatch: 1,
+			SpoolDir:               dir,
+		})
+		run(spoolNozzle)
+
+		Eventually(spoolHumioClient.GetLastPushedEvents).Should(Equal(`[{"tags":{"appid":"spooled"},"events":[]}]`))
+		Eventually(s.Segments).Should(BeEmpty())
+	})
+
+	It("stops retrying spooled batches when stopped", func() {
+		dir, err := ioutil.TempDir("", "spool")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		s, err := spool.NewSpool(dir, 0, logger)
+		Expect(err).NotTo(HaveOccurred())
+		s.Write([]byte(`[{"tags":{"appid":"spooled"},"events":[]}]`))
+
+		spoolNozzle, _, spoolHumioClient := newNozzle(&nozzle.NozzleConfig{
+			HumioBatchTime:         10 * time.Millisecond,
+			HumioMaxMsgNumPerBatch: 1,
+			SpoolDir:               dir,
+			DrainTimeout:           time.Second,
+		})
+		spoolHumioClient.Err = errors.New("unavailable")
+
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- spoolNozzle.Start()
+		}()
+		Eventually(spoolHumioClient.GetPushCount).Should(BeNumerically(">", 1))
+		spoolNozzle.Stop()
+		Eventually(stopped).Should(Receive())
+
+		pushes := spoolHumioClient.GetPushCount()
+		Consistently(spoolHumioClient.GetPushCount, 100*time.Millisecond).Should(BeNumerically("<=", pushes+1))
+	})
+
+	It("spools batches in flush order", func() {
+		dir, err := ioutil.TempDir("", "spool")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		spoolNozzle, spoolFirehoseClient, spoolHumioClient := newNozzle(&nozzle.NozzleConfig{
+			HumioBatchTime:         time.Hour,
+			HumioMaxMsgNumPerBatch: 1,
+			SenderWorkers:          4,
+			SpoolDir:               dir,
+		})
+		spoolHumioClient.Release = make(chan struct{})
+		defer close(spoolHumioClient.Release)
+		run(spoolNozzle)
+
+		sent := []string{"0", "1", "2", "3", "4", "5", "6", "7"}
+		for _, message := range sent {
+			spoolFirehoseClient.MessageChan <- logEnvelope("", message)
+		}
+
+		s, err := spool.NewSpool(dir, 0, logger)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(s.Segments).Should(HaveLen(len(sent)))
+
+		segments, _ := s.Segments()
+		var spooled []string
+		for _, segment := range segments {
+			payload, err := s.Read(segment)
+			Expect(err).NotTo(HaveOccurred())
+			var groups []humio.Events
+			Expect(json.Unmarshal(payload, &groups)).To(Succeed())
+			spooled = append(spooled, groups[0].Events[0].Attributes.Log.Message)
+		}
+		Expect(spooled).To(Equal(sent))
+	})
+
+	It("drops the newest batches when the sender queue is full", func() {
+		slowNozzle, slowFirehoseClient, slowHumioClient := newNozzle(&nozzle.NozzleConfig{
+			HumioBatchTime:         time.Hour,
+			HumioMaxMsgNumPerBatch: 1,
+			SenderWorkers:          1,
+			SenderQueueSize:        1,
+			OverflowPolicy:         nozzle.OverflowDropNewest,
+		})
+		slowHumioClient.Release = make(chan struct{})
+		defer close(slowHumioClient.Release)
+		run(slowNozzle)
+
+		for i := 0; i < 4; i++ {
+			slowFirehoseClient.MessageChan <- logEnvelope("", "")
+		}
+
+		Eventually(slowNozzle.DroppedEvents).Should(BeNumerically(">=", 1))
+	})
+
+	It("flushes pending events when stopped", func() {
+		stopNozzle, stopFirehoseClient, stopHumioClient := newNozzle(&nozzle.NozzleConfig{
+			HumioBatchTime:         time.Hour,
+			HumioMaxMsgNumPerBatch: 10,
+			DrainTimeout:           time.Second,
+		})
+
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- stopNozzle.Start()
+		}()
+
+		stopFirehoseClient.MessageChan <- logEnvelope("", "")
+		stopNozzle.Stop()
+
+		Eventually(stopped).Should(Receive(BeNil()))
+		Expect(stopHumioClient.GetPushCount()).To(Equal(1))
+		Expect(cachingClient.IsStopped()).To(BeTrue())
+	})
+
+	It("routes events to the first matching route", func() {
+		teamHumioClient := mocks.NewMockHumioClient()
+		routeNozzle, routeFirehoseClient, defaultHumioClient := newNozzle(&nozzle.NozzleConfig{
+			HumioBatchTime:         time.Hour,
+			HumioMaxMsgNumPerBatch: 1,
+			Routes: []nozzle.Route{
+				{Name: "team", Match: humio.RouteMatch{Org: "team-org"}, Client: teamHumioClient},
+			},
+		})
+		run(routeNozzle)
+
+		cachingClient.MockGetAppInfo = func(appGuid string) caching.AppInfo {
+			if appGuid == "team-app" {
+				return caching.AppInfo{Org: "team-org"}
+			}
+			return caching.AppInfo{}
+		}
+
+		for _, appID := range []string{"team-app", "other-app", "team-app"} {
+			routeFirehoseClient.MessageChan <- logEnvelope(appID, "")
+		}
+
+		Eventually(teamHumioClient.GetPushCount).Should(Equal(2))
+		Eventually(defaultHumioClient.GetPushCount).Should(Equal(1))
+		Eventually(func() uint64 { return routeNozzle.Stats()["team"].SentEvents }).Should(Equal(uint64(2)))
+		Expect(routeNozzle.Stats()).To(HaveKey(humio.DefaultRoute))
+	})
+
+	Context("with multiline reassembly", func() {
+		BeforeEach(func() {
+			cachingClient.MockGetAppInfo = func(appGuid string) caching.AppInfo {
+				return caching.AppInfo{}
+			}
+		})
+
+		It("joins continuation lines to the line starting the record", func() {
+			multilineNozzle, multilineFirehoseClient, multilineHumioClient := newNozzle(&nozzle.NozzleConfig{
+				HumioBatchTime:         time.Hour,
+				HumioMaxMsgNumPerBatch: 1,
+				Multiline: &nozzle.MultilineConfig{
+					StartPattern: regexp.MustCompile(`^\S`),
+					FlushTimeout: time.Hour,
+				},
+			})
+			run(multilineNozzle)
+
+			multilineFirehoseClient.MessageChan <- logEnvelope("app1", "java.lang.NullPointerException")
+			multilineFirehoseClient.MessageChan <- logEnvelope("app2", "GET /")
+			multilineFirehoseClient.MessageChan <- logEnvelope("app1", "\tat Main.main(Main.java:1)")
+			multilineFirehoseClient.MessageChan <- logEnvelope("app1", "done")
+
+			Eventually(func() string {
+				return lastEvent(multilineHumioClient).Attributes.Log.Message
+			}).Should(Equal("java.lang.NullPointerException\n\tat Main.main(Main.java:1)"))
+			Expect(multilineHumioClient.GetPushCount()).To(Equal(1))
+		})
+
+		It("sends records once they are too long or complete", func() {
+			multilineNozzle, multilineFirehoseClient, multilineHumioClient := newNozzle(&nozzle.NozzleConfig{
+				HumioBatchTime:         time.Hour,
+				HumioMaxMsgNumPerBatch: 1,
+				Multiline: &nozzle.MultilineConfig{
+					StartPattern: regexp.MustCompile(`^\S`),
+					MaxLines:     2,
+					FlushTimeout: 20 * time.Millisecond,
+				},
+			})
+			run(multilineNozzle)
+			pushedMessage := func() string {
+				return lastEvent(multilineHumioClient).Attributes.Log.Message
+			}
+
+			multilineFirehoseClient.MessageChan <- logEnvelope("app1", "Traceback")
+			multilineFirehoseClient.MessageChan <- logEnvelope("app1", "  line 1")
+			Eventually(pushedMessage).Should(Equal("Traceback\n  line 1"))
+
+			multilineFirehoseClient.MessageChan <- logEnvelope("app1", "single")
+			Eventually(pushedMessage).Should(Equal("single"))
+		})
+
+		It("starts records at lines which aren't indented without a start pattern", func() {
+			multilineNozzle, multilineFirehoseClient, multilineHumioClient := newNozzle(&nozzle.NozzleConfig{
+				HumioBatchTime:         time.Hour,
+				HumioMaxMsgNumPerBatch: 1,
+				Multiline: &nozzle.MultilineConfig{
+					FlushTimeout: time.Hour,
+				},
+			})
+			run(multilineNozzle)
+
+			multilineFirehoseClient.MessageChan <- logEnvelope("app1", "Traceback")
+			multilineFirehoseClient.MessageChan <- logEnvelope("app1", "  line 1")
+			multilineFirehoseClient.MessageChan <- logEnvelope("app1", "done")
+
+			Eventually(func() string {
+				return lastEvent(multilineHumioClient).Attributes.Log.Message
+			}).Should(Equal("Traceback\n  line 1"))
+		})
+	})
+
+	Context("with app info lookups", func() {
+		var lookupDone chan struct{}
+
+		BeforeEach(func() {
+			// lookups of earlier specs may still be running
+			done := make(chan struct{})
+			lookupDone = done
+			looked := make(chan struct{})
+			cachingClient.MockGetCachedAppInfo = func(appGuid string) (caching.AppInfo, bool) {
+				select {
+				case <-looked:
+					return caching.AppInfo{Name: "slow-app", Org: "team-org"}, true
+				default:
+					return caching.AppInfo{}, false
+				}
+			}
+			cachingClient.MockGetAppInfo = func(appGuid string) caching.AppInfo {
+				<-done
+				close(looked)
+				return caching.AppInfo{Name: "slow-app", Org: "team-org"}
+			}
+		})
+
+		It("sends other events while an app is looked up", func() {
+			enrichNozzle, enrichFirehoseClient, enrichHumioClient := newNozzle(&nozzle.NozzleConfig{
+				HumioBatchTime:         time.Hour,
+				HumioMaxMsgNumPerBatch: 1,
+				EnrichTimeout:          time.Hour,
+			})
+			run(enrichNozzle)
+
+			enrichFirehoseClient.MessageChan <- logEnvelope("app1", "first")
+			enrichFirehoseClient.MessageChan <- logEnvelope("", "platform")
+			Eventually(func() string {
+				return lastEvent(enrichHumioClient).Attributes.Log.Message
+			}).Should(Equal("platform"))
+			Expect(enrichHumioClient.GetPushCount()).To(Equal(1))
+
+			close(lookupDone)
+			Eventually(func() string {
+				return lastEvent(enrichHumioClient).Attributes.App.Name
+			}).Should(Equal("slow-app"))
+			Expect(lastEvent(enrichHumioClient).Attributes.Log.Message).To(Equal("first"))
+		})
+
+		It("sends routed events to their route once their app is looked up", func() {
+			teamHumioClient := mocks.NewMockHumioClient()
+			enrichNozzle, enrichFirehoseClient, enrichHumioClient := newNozzle(&nozzle.NozzleConfig{
+				HumioBatchTime:         time.Hour,
+				HumioMaxMsgNumPerBatch: 1,
+				EnrichTimeout:          time.Hour,
+				Routes: []nozzle.Route{
+					{Name: "team", Match: humio.RouteMatch{Org: "team-org"}, Client: teamHumioClient},
+				},
+			})
+			run(enrichNozzle)
+
+			enrichFirehoseClient.MessageChan <- logEnvelope("app1", "first")
+			Consistently(enrichHumioClient.GetPushCount, 50*time.Millisecond).Should(BeZero())
+
+			close(lookupDone)
+			Eventually(teamHumioClient.GetPushCount).Should(Equal(1))
+			Expect(enrichHumioClient.GetPushCount()).To(BeZero())
+			Expect(enrichNozzle.UnenrichedEvents()).To(BeZero())
+		})
+
+		It("sends routed events to the default route once the lookup timed out", func() {
+			defer close(lookupDone)
+			teamHumioClient := mocks.NewMockHumioClient()
+			enrichNozzle, enrichFirehoseClient, enrichHumioClient := newNozzle(&nozzle.NozzleConfig{
+				HumioBatchTime:         time.Hour,
+				HumioMaxMsgNumPerBatch: 1,
+				EnrichTimeout:          20 * time.Millisecond,
+				Routes: []nozzle.Route{
+					{Name: "team", Match: humio.RouteMatch{Org: "team-org"}, Client: teamHumioClient},
+				},
+			})
+			run(enrichNozzle)
+
+			enrichFirehoseClient.MessageChan <- logEnvelope("app1", "first")
+			Eventually(enrichHumioClient.GetPushCount).Should(Equal(1))
+			Expect(teamHumioClient.GetPushCount()).To(BeZero())
+			Expect(enrichNozzle.UnenrichedEvents()).To(Equal(uint64(1)))
+			var actions []string
+			for _, log := range logger.GetLogs(lager.ERROR) {
+				actions = append(actions, log.Action)
+			}
+			Expect(actions).To(ContainElement("sending events without app info, they may go to the default route"))
+		})
+
+		It("stops within the drain timeout while an app is looked up", func() {
+			defer close(lookupDone)
+			enrichNozzle, enrichFirehoseClient, _ := newNozzle(&nozzle.NozzleConfig{
+				HumioBatchTime:         time.Hour,
+				HumioMaxMsgNumPerBatch: 1,
+				EnrichTimeout:          time.Hour,
+				DrainTimeout:           50 * time.Millisecond,
+			})
+
+			stopped := make(chan error, 1)
+			go func() {
+				stopped <- enrichNozzle.Start()
+			}()
+
+			enrichFirehoseClient.MessageChan <- logEnvelope("app1", "first")
+			enrichNozzle.Stop()
+
+			Eventually(stopped, time.Second).Should(Receive())
+			Expect(enrichNozzle.UnenrichedEvents()).To(Equal(uint64(1)))
+		})
+
+		It("sends events without app info once the lookup timed out", func() {
+			defer close(lookupDone)
+			enrichNozzle, enrichFirehoseClient, enrichHumioClient := newNozzle(&nozzle.NozzleConfig{
+				HumioBatchTime:         time.Hour,
+				HumioMaxMsgNumPerBatch: 1,
+				EnrichTimeout:          20 * time.Millisecond,
+			})
+			run(enrichNozzle)
+
+			enrichFirehoseClient.MessageChan <- logEnvelope("app1", "first")
+			Eventually(enrichHumioClient.GetPushCount).Should(Equal(1))
+			Expect(lastEvent(enrichHumioClient).Attributes.Log.Message).To(Equal("first"))
+			Expect(lastEvent(enrichHumioClient).Attributes.App.Name).To(BeEmpty())
+		})
+	})
 })
@@ -0,0 +1,61 @@
+package nozzle
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	noaaerrors "github.com/cloudfoundry/noaa/errors"
+)
+
+// maxAuthFailures is the number of consecutive authentication failures after
+// which the nozzle stops reconnecting, as retrying with bad credentials only
+// ends up locking the firehose user.
+const maxAuthFailures = 3
+
+type disconnectReason int
+
+const (
+	disconnectError disconnectReason = iota
+	disconnectSlowConsumer
+	disconnectUnauthorized
+)
+
+func classifyDisconnect(err error) disconnectReason {
+	if err == nil {
+		return disconnectError
+	}
+	if retryErr, ok := err.(noaaerrors.RetryError); ok {
+		err = retryErr.Err
+	}
+	if _, ok := err.(*noaaerrors.UnauthorizedError); ok {
+		return disconnectUnauthorized
+	}
+
+	msg := err.Error()
+	if strings.Contains(msg, "close 1008 (policy violation)") {
+		return disconnectSlowConsumer
+	}
+	lower := strings.ToLower(msg)
+	if strings.Contains(lower, "unauthorized") || strings.Contains(lower, "invalid_grant") {
+		return disconnectUnauthorized
+	}
+	return disconnectError
+}
+
+// backoff returns the jittered exponential delay before reconnect attempt n
+// (starting at 1), capped at max.
+func backoff(n int, min time.Duration, max time.Duration) time.Duration {
+	if min <= 0 {
+		return 0
+	}
+	delay := min
+	for i := 1; i < n && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
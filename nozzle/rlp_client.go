@@ -0,0 +1,462 @@
+package nozzle
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// TokenRefresher supplies the oauth token used to authenticate against the
+// RLP gateway.
+type TokenRefresher interface {
+	RefreshAuthToken() (string, error)
+}
+
+// cfConfigTokenRefresher logs in with a fresh cfclient for every token so
+// that reconnects never reuse an expired session.
+type cfConfigTokenRefresher struct {
+	cfClientConfig *cfclient.Config
+}
+
+func (r *cfConfigTokenRefresher) RefreshAuthToken() (string, error) {
+	cfClient, err := cfclient.NewClient(r.cfClientConfig)
+	if err != nil {
+		return "", err
+	}
+	return cfClient.GetToken()
+}
+
+type rlpClient struct {
+	tokenRefresher TokenRefresher
+	firehoseConfig *FirehoseConfig
+	httpClient     *http.Client
+	logger         lager.Logger
+	cancel         context.CancelFunc
+	cancelLock     sync.Mutex
+}
+
+// NewRLPGatewayClient returns a FirehoseClient reading loggregator V2
+// envelopes from the Reverse Log Proxy gateway and converting them into the
+// V1 envelopes handled by the rest of the nozzle.
+func NewRLPGatewayClient(cfClientConfig *cfclient.Config, firehoseConfig *FirehoseConfig, logger lager.Logger) FirehoseClient {
+	return newRLPGatewayClient(
+		&cfConfigTokenRefresher{cfClientConfig: cfClientConfig},
+		firehoseConfig,
+		cfClientConfig.SkipSslValidation,
+		logger)
+}
+
+func newRLPGatewayClient(tokenRefresher TokenRefresher, firehoseConfig *FirehoseConfig, skipSslValidation bool, logger lager.Logger) *rlpClient {
+	return &rlpClient{
+		tokenRefresher: tokenRefresher,
+		firehoseConfig: firehoseConfig,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: skipSslValidation},
+			},
+		},
+		logger: logger,
+	}
+}
+
+func (c *rlpClient) Connect() (<-chan *events.Envelope, <-chan error) {
+	c.logger.Debug("connect", lager.Data{"rlpGatewayAddress": c.firehoseConfig.RLPGatewayUrl})
+
+	msgChan := make(chan *events.Envelope)
+	errChan := make(chan error, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancelLock.Lock()
+	c.cancel = cancel
+	c.cancelLock.Unlock()
+
+	go func() {
+		defer close(errChan)
+		defer close(msgChan)
+		defer cancel()
+
+		err := c.stream(ctx, msgChan)
+		if ctx.Err() != nil {
+			// closed by CloseConsumer
+			return
+		}
+		errChan <- err
+	}()
+
+	return msgChan, errChan
+}
+
+func (c *rlpClient) CloseConsumer() error {
+	c.cancelLock.Lock()
+	defer c.cancelLock.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+	return nil
+}
+
+func (c *rlpClient) stream(ctx context.Context, msgChan chan<- *events.Envelope) error {
+	token, err := c.tokenRefresher.RefreshAuthToken()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", c.readURL(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("RLP gateway returned unauthorized (%d): %s", resp.StatusCode, body)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("RLP gateway returned an unexpected response (%d): %s", resp.StatusCode, body)
+	}
+
+	// the gateway sends heartbeats, so a silent stream is a dead one
+	var idleTimer *time.Timer
+	if c.firehoseConfig.IdleTimeout > 0 {
+		idleTimer = time.AfterFunc(c.firehoseConfig.IdleTimeout, func() { resp.Body.Close() })
+		defer idleTimer.Stop()
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	var eventName string
+	var data bytes.Buffer
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("RLP gateway stream ended: %s", err)
+		}
+		if idleTimer != nil {
+			idleTimer.Reset(c.firehoseConfig.IdleTimeout)
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			if eventName == "closing" {
+				return errors.New("RLP gateway closed the stream")
+			}
+			if data.Len() > 0 && eventName != "heartbeat" {
+				if err := c.dispatch(ctx, data.Bytes(), msgChan); err != nil {
+					return err
+				}
+			}
+			eventName = ""
+			data.Reset()
+		case bytes.HasPrefix(line, []byte(":")):
+			// comment
+		case bytes.HasPrefix(line, []byte("event:")):
+			eventName = string(bytes.TrimSpace(line[len("event:"):]))
+		case bytes.HasPrefix(line, []byte("data:")):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(bytes.TrimPrefix(line[len("data:"):], []byte(" ")))
+		}
+	}
+}
+
+func (c *rlpClient) dispatch(ctx context.Context, data []byte, msgChan chan<- *events.Envelope) error {
+	var batch v2EnvelopeBatch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		c.logger.Error("failed decoding RLP gateway batch", err)
+		return nil
+	}
+
+	for _, v2 := range batch.Batch {
+		for _, e := range convertV2Envelope(v2) {
+			select {
+			case msgChan <- e:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (c *rlpClient) readURL() string {
+	query := url.Values{}
+	query.Set("shard_id", c.firehoseConfig.SubscriptionId)
+	for _, selector := range c.firehoseConfig.EventSubscription.rlpSelectors() {
+		query.Set(selector, "")
+	}
+	for _, sourceID := range c.firehoseConfig.RLPSourceIDs {
+		query.Add("source_id", sourceID)
+	}
+	return strings.TrimRight(c.firehoseConfig.RLPGatewayUrl, "/") + "/v2/read?" + query.Encode()
+}
+
+// rlpSelectors maps the subscription onto the V2 envelope selectors of the
+// gateway. Error envelopes have no V2 equivalent, and V2 event envelopes
+// have no V1 equivalent, so they aren't subscribed to.
+func (s *EventSubscription) rlpSelectors() []string {
+	if s == nil || s.All {
+		return []string{"counter", "gauge", "log", "timer"}
+	}
+
+	selected := make(map[string]bool)
+	for t := range s.Types {
+		switch t {
+		case events.Envelope_LogMessage:
+			selected["log"] = true
+		case events.Envelope_CounterEvent:
+			selected["counter"] = true
+		case events.Envelope_ValueMetric, events.Envelope_ContainerMetric:
+			selected["gauge"] = true
+		case events.Envelope_HttpStartStop:
+			selected["timer"] = true
+		}
+	}
+
+	var selectors []string
+	for selector := range selected {
+		selectors = append(selectors, selector)
+	}
+	sort.Strings(selectors)
+	return selectors
+}
+
+type v2EnvelopeBatch struct {
+	Batch []v2Envelope `json:"batch"`
+}
+
+type v2Envelope struct {
+	Timestamp  jsonInt64         `json:"timestamp"`
+	SourceID   string            `json:"source_id"`
+	InstanceID string            `json:"instance_id"`
+	Tags       map[string]string `json:"tags"`
+	Log        *struct {
+		Payload []byte `json:"payload"`
+		Type    string `json:"type"`
+	} `json:"log"`
+	Counter *struct {
+		Name  string     `json:"name"`
+		Delta jsonUint64 `json:"delta"`
+		Total jsonUint64 `json:"total"`
+	} `json:"counter"`
+	Gauge *struct {
+		Metrics map[string]struct {
+			Unit  string  `json:"unit"`
+			Value float64 `json:"value"`
+		} `json:"metrics"`
+	} `json:"gauge"`
+	Timer *struct {
+		Name  string    `json:"name"`
+		Start jsonInt64 `json:"start"`
+		Stop  jsonInt64 `json:"stop"`
+	} `json:"timer"`
+}
+
+// jsonInt64 accepts 64 bit integers both as JSON numbers and as the quoted
+// strings produced by the gateway's protobuf JSON mapping.
+type jsonInt64 int64
+
+func (i *jsonInt64) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	*i = jsonInt64(v)
+	return err
+}
+
+type jsonUint64 uint64
+
+func (i *jsonUint64) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	*i = jsonUint64(v)
+	return err
+}
+
+var containerMetricNames = []string{"cpu", "memory", "disk", "memory_quota", "disk_quota"}
+
+// convertV2Envelope converts a V2 envelope into the V1 envelopes it
+// corresponds to, following loggregator's own V2 to V1 conversion.
+func convertV2Envelope(v2 v2Envelope) []*events.Envelope {
+	switch {
+	case v2.Log != nil:
+		e := newV1Envelope(v2, events.Envelope_LogMessage)
+		messageType := events.LogMessage_OUT
+		if v2.Log.Type == "ERR" {
+			messageType = events.LogMessage_ERR
+		}
+		e.LogMessage = &events.LogMessage{
+			Message:        v2.Log.Payload,
+			MessageType:    &messageType,
+			Timestamp:      proto.Int64(int64(v2.Timestamp)),
+			AppId:          proto.String(v2.SourceID),
+			SourceType:     proto.String(v2.Tags["source_type"]),
+			SourceInstance: proto.String(v2.InstanceID),
+		}
+		return []*events.Envelope{e}
+	case v2.Counter != nil:
+		e := newV1Envelope(v2, events.Envelope_CounterEvent)
+		e.CounterEvent = &events.CounterEvent{
+			Name:  proto.String(v2.Counter.Name),
+			Delta: proto.Uint64(uint64(v2.Counter.Delta)),
+			Total: proto.Uint64(uint64(v2.Counter.Total)),
+		}
+		return []*events.Envelope{e}
+	case v2.Gauge != nil:
+		return convertV2Gauge(v2)
+	case v2.Timer != nil:
+		return []*events.Envelope{convertV2Timer(v2)}
+	}
+	return nil
+}
+
+func convertV2Gauge(v2 v2Envelope) []*events.Envelope {
+	isContainerMetric := true
+	for _, name := range containerMetricNames {
+		if _, ok := v2.Gauge.Metrics[name]; !ok {
+			isContainerMetric = false
+			break
+		}
+	}
+
+	if isContainerMetric {
+		e := newV1Envelope(v2, events.Envelope_ContainerMetric)
+		instanceIndex, _ := strconv.ParseInt(v2.InstanceID, 10, 32)
+		e.ContainerMetric = &events.ContainerMetric{
+			ApplicationId:    proto.String(v2.SourceID),
+			InstanceIndex:    proto.Int32(int32(instanceIndex)),
+			CpuPercentage:    proto.Float64(v2.Gauge.Metrics["cpu"].Value),
+			MemoryBytes:      proto.Uint64(uint64(v2.Gauge.Metrics["memory"].Value)),
+			DiskBytes:        proto.Uint64(uint64(v2.Gauge.Metrics["disk"].Value)),
+			MemoryBytesQuota: proto.Uint64(uint64(v2.Gauge.Metrics["memory_quota"].Value)),
+			DiskBytesQuota:   proto.Uint64(uint64(v2.Gauge.Metrics["disk_quota"].Value)),
+		}
+		return []*events.Envelope{e}
+	}
+
+	var envelopes []*events.Envelope
+	for name, metric := range v2.Gauge.Metrics {
+		e := newV1Envelope(v2, events.Envelope_ValueMetric)
+		e.ValueMetric = &events.ValueMetric{
+			Name:  proto.String(name),
+			Value: proto.Float64(metric.Value),
+			Unit:  proto.String(metric.Unit),
+		}
+		envelopes = append(envelopes, e)
+	}
+	return envelopes
+}
+
+func convertV2Timer(v2 v2Envelope) *events.Envelope {
+	e := newV1Envelope(v2, events.Envelope_HttpStartStop)
+	h := &events.HttpStartStop{
+		StartTimestamp: proto.Int64(int64(v2.Timer.Start)),
+		StopTimestamp:  proto.Int64(int64(v2.Timer.Stop)),
+		RequestId:      parseUUID(v2.Tags["request_id"]),
+		Uri:            proto.String(v2.Tags["uri"]),
+		RemoteAddress:  proto.String(v2.Tags["remote_address"]),
+		UserAgent:      proto.String(v2.Tags["user_agent"]),
+		InstanceId:     proto.String(v2.Tags["instance_id"]),
+		ApplicationId:  parseUUID(v2.SourceID),
+	}
+
+	if peerType, ok := events.PeerType_value[v2.Tags["peer_type"]]; ok {
+		h.PeerType = events.PeerType(peerType).Enum()
+	}
+	if method, ok := events.Method_value[v2.Tags["method"]]; ok {
+		h.Method = events.Method(method).Enum()
+	}
+	if statusCode, err := strconv.ParseInt(v2.Tags["status_code"], 10, 32); err == nil {
+		h.StatusCode = proto.Int32(int32(statusCode))
+	}
+	if contentLength, err := strconv.ParseInt(v2.Tags["content_length"], 10, 64); err == nil {
+		h.ContentLength = proto.Int64(contentLength)
+	}
+	if instanceIndex, err := strconv.ParseInt(v2.Tags["instance_index"], 10, 32); err == nil {
+		h.InstanceIndex = proto.Int32(int32(instanceIndex))
+	}
+	if forwarded := v2.Tags["forwarded"]; forwarded != "" {
+		h.Forwarded = strings.Split(forwarded, "\n")
+	}
+
+	e.HttpStartStop = h
+	return e
+}
+
+var v1EnvelopeTags = map[string]bool{
+	"origin":     true,
+	"deployment": true,
+	"job":        true,
+	"index":      true,
+	"ip":         true,
+}
+
+func newV1Envelope(v2 v2Envelope, eventType events.Envelope_EventType) *events.Envelope {
+	tags := make(map[string]string)
+	for k, v := range v2.Tags {
+		if !v1EnvelopeTags[k] {
+			tags[k] = v
+		}
+	}
+
+	return &events.Envelope{
+		Origin:     proto.String(v2.Tags["origin"]),
+		EventType:  &eventType,
+		Timestamp:  proto.Int64(int64(v2.Timestamp)),
+		Deployment: proto.String(v2.Tags["deployment"]),
+		Job:        proto.String(v2.Tags["job"]),
+		Index:      proto.String(v2.Tags["index"]),
+		Ip:         proto.String(v2.Tags["ip"]),
+		Tags:       tags,
+	}
+}
+
+// parseUUID is the inverse of the UUID formatting done in the humio package.
+func parseUUID(s string) *events.UUID {
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		return nil
+	}
+	return &events.UUID{
+		Low:  proto.Uint64(binary.LittleEndian.Uint64(b[:8])),
+		High: proto.Uint64(binary.LittleEndian.Uint64(b[8:])),
+	}
+}
@@ -0,0 +1,76 @@
+package nozzle_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/humio/cloudfoundry2humio/mocks"
+	"github.com/humio/cloudfoundry2humio/nozzle"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type staticTokenRefresher string
+
+func (t staticTokenRefresher) RefreshAuthToken() (string, error) {
+	return string(t), nil
+}
+
+var _ = Describe("RLP gateway client", func() {
+	var (
+		server   *httptest.Server
+		requests chan *http.Request
+		client   nozzle.FirehoseClient
+	)
+
+	BeforeEach(func() {
+		requests = make(chan *http.Request, 1)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: heartbeat\ndata: 1\n\n")
+			fmt.Fprint(w, `data: {"batch":[{"timestamp":"1000000000","source_id":"app-guid","instance_id":"2","tags":{"source_type":"APP/PROC/WEB","deployment":"cf"},"log":{"payload":"aGVsbG8=","type":"ERR"}}]}`+"\n\n")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}))
+
+		subscription, _ := nozzle.ParseEventSubscription("LogMessage,HttpStartStop")
+		client = nozzle.NewRLPGatewayClientWithTokenRefresher(staticTokenRefresher("bearer token"), &nozzle.FirehoseConfig{
+			SubscriptionId:    "humio-nozzle",
+			IdleTimeout:       time.Second,
+			EventSubscription: subscription,
+			RLPGatewayUrl:     server.URL,
+		}, mocks.NewMockLogger())
+	})
+
+	AfterEach(func() {
+		client.CloseConsumer()
+		server.Close()
+	})
+
+	It("reads V2 envelopes as V1 envelopes", func() {
+		msgChan, _ := client.Connect()
+
+		var request *http.Request
+		Eventually(requests).Should(Receive(&request))
+		Expect(request.URL.Path).To(Equal("/v2/read"))
+		Expect(request.URL.Query()).To(HaveKey("log"))
+		Expect(request.URL.Query()).To(HaveKey("timer"))
+		Expect(request.URL.Query()).NotTo(HaveKey("gauge"))
+		Expect(request.URL.Query().Get("shard_id")).To(Equal("humio-nozzle"))
+		Expect(request.Header.Get("Authorization")).To(Equal("bearer token"))
+
+		var envelope *events.Envelope
+		Eventually(msgChan).Should(Receive(&envelope))
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_LogMessage))
+		Expect(envelope.GetDeployment()).To(Equal("cf"))
+		Expect(envelope.GetLogMessage().GetMessage()).To(Equal([]byte("hello")))
+		Expect(envelope.GetLogMessage().GetMessageType()).To(Equal(events.LogMessage_ERR))
+		Expect(envelope.GetLogMessage().GetAppId()).To(Equal("app-guid"))
+		Expect(envelope.GetLogMessage().GetSourceType()).To(Equal("APP/PROC/WEB"))
+		Expect(envelope.GetLogMessage().GetSourceInstance()).To(Equal("2"))
+	})
+})
@@ -0,0 +1,179 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/humio/cloudfoundry2humio/humio"
+)
+
+// OverflowPolicy decides what happens to a batch when the sender queue is
+// full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock stops reading the firehose until a sender is free.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued batch.
+	OverflowDropOldest
+	// OverflowDropNewest discards the batch being queued.
+	OverflowDropNewest
+)
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch strings.ToLower(s) {
+	case "block":
+		return OverflowBlock, nil
+	case "drop-oldest":
+		return OverflowDropOldest, nil
+	case "drop-newest":
+		return OverflowDropNewest, nil
+	}
+	return OverflowBlock, fmt.Errorf("unknown overflow policy: %s", s)
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	}
+	return "block"
+}
+
+// senderPool sends batches to Humio from a fixed number of workers reading a
+// bounded queue, so a slow Humio can't pile up goroutines and memory.
+type senderPool struct {
+	// accessed atomically, kept first for 64 bit alignment
+	droppedBatches uint64
+	droppedEvents  uint64
+
+	route     string
+	queue     chan *humio.Batch
+	policy    OverflowPolicy
+	workers   int
+	send      func(*humio.Batch)
+	logger    lager.Logger
+	startOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func newSenderPool(workers int, queueSize int, policy OverflowPolicy, send func(*humio.Batch), logger lager.Logger) *senderPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	return &senderPool{
+		queue:   make(chan *humio.Batch, queueSize),
+		policy:  policy,
+		workers: workers,
+		send:    send,
+		logger:  logger,
+	}
+}
+
+func (p *senderPool) start() {
+	p.startOnce.Do(func() {
+		p.wg.Add(p.workers)
+		for i := 0; i < p.workers; i++ {
+			go func() {
+				defer p.wg.Done()
+				for b := range p.queue {
+					p.send(b)
+				}
+			}()
+		}
+	})
+}
+
+// submit queues the batch according to the overflow policy.
+func (p *senderPool) submit(b *humio.Batch) {
+	if b.Len() == 0 {
+		return
+	}
+
+	switch p.policy {
+	case OverflowDropNewest:
+		select {
+		case p.queue <- b:
+		default:
+			p.dropped(b)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case p.queue <- b:
+				return
+			default:
+			}
+			select {
+			case oldest := <-p.queue:
+				p.dropped(oldest)
+			default:
+			}
+		}
+	default:
+		p.queue <- b
+	}
+}
+
+// drain queues the final batch, regardless of the overflow policy, and waits
+// for the workers to send everything queued until ctx is done. The pool
+// can't be used afterwards.
+func (p *senderPool) drain(ctx context.Context, final *humio.Batch) bool {
+	done := make(chan struct{})
+	go func() {
+		if final.Len() > 0 {
+			p.queue <- final
+		}
+		close(p.queue)
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *senderPool) dropped(b *humio.Batch) {
+	batches := atomic.AddUint64(&p.droppedBatches, 1)
+	events := atomic.AddUint64(&p.droppedEvents, uint64(b.Len()))
+	p.logger.Error("sender queue is full, dropped a batch", nil, lager.Data{
+		"route":                 p.route,
+		"policy":                p.policy.String(),
+		"events":                b.Len(),
+		"total_dropped_batches": batches,
+		"total_dropped_events":  events,
+	})
+}
+
+// DroppedBatches returns the number of batches discarded by the overflow
+// policy, across all routes.
+func (o *HumioNozzle) DroppedBatches() uint64 {
+	var batches uint64
+	for _, d := range o.destinations {
+		batches += atomic.LoadUint64(&d.sender.droppedBatches)
+	}
+	return batches
+}
+
+// DroppedEvents returns the number of events discarded by the overflow
+// policy, across all routes.
+func (o *HumioNozzle) DroppedEvents() uint64 {
+	var events uint64
+	for _, d := range o.destinations {
+		events += atomic.LoadUint64(&d.sender.droppedEvents)
+	}
+	return events
+}
@@ -0,0 +1,107 @@
+package nozzle
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/humio/cloudfoundry2humio/humio"
+)
+
+// spoolEvents writes the batch to the spool and wakes up the spool drainer,
+// which is the only sender to Humio while spooling so that batches are
+// delivered in order.
+func (d *destination) spoolEvents(b *humio.Batch) {
+	logger := d.nozzle.logger
+
+	payload, err := json.Marshal(b.Groups())
+	if err != nil {
+		logger.Error("failed encoding events for the spool", err, lager.Data{"route": d.name})
+		return
+	}
+
+	if _, err := d.spool.Write(payload); err != nil {
+		// fall back to the senders rather than losing the batch
+		logger.Error("failed writing events to the spool", err, lager.Data{"route": d.name})
+		d.sender.submit(b)
+		return
+	}
+
+	select {
+	case d.spoolNotify <- struct{}{}:
+	default:
+	}
+}
+
+// drainSpool sends the spooled batches whenever new ones are written, until
+// the nozzle has stopped.
+func (d *destination) drainSpool() {
+	ctx := d.nozzle.ctx
+	for {
+		if !d.pushSpooledBatches() {
+			// Humio is unreachable, wait before trying the oldest batch again
+			select {
+			case <-time.After(d.nozzle.nozzleConfig.HumioBatchTime):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		select {
+		case <-d.spoolNotify:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pushSpooledBatches sends all spooled batches oldest first and reports
+// whether the spool could be emptied.
+func (d *destination) pushSpooledBatches() bool {
+	logger := d.nozzle.logger
+
+	segments, err := d.spool.Segments()
+	if err != nil {
+		logger.Error("failed listing spool segments", err, lager.Data{"route": d.name})
+		return false
+	}
+
+	for _, segment := range segments {
+		payload, err := d.spool.Read(segment)
+		if err != nil {
+			// evicted in the meantime
+			continue
+		}
+
+		var groups []humio.Events
+		if err := json.Unmarshal(payload, &groups); err != nil {
+			logger.Error("dropping corrupt spool segment", err, lager.Data{"route": d.name, "segment": segment})
+			d.spool.Remove(segment)
+			continue
+		}
+
+		events := 0
+		for _, g := range groups {
+			events += len(g.Events)
+		}
+
+		if err := d.client.PushEvents(d.nozzle.ctx, groups); err != nil {
+			if ingestErr, ok := err.(*humio.IngestError); ok && !ingestErr.Temporary() {
+				// Humio will never accept this batch
+				atomic.AddUint64(&d.failedEvents, uint64(events))
+				logger.Error("dropping spooled batch rejected by Humio", err, lager.Data{"route": d.name, "segment": segment})
+				d.spool.Remove(segment)
+				continue
+			}
+			logger.Error("failed sending spooled events to Humio", err, lager.Data{"route": d.name, "segment": segment})
+			return false
+		}
+		atomic.AddUint64(&d.sentEvents, uint64(events))
+
+		if err := d.spool.Remove(segment); err != nil {
+			logger.Error("failed removing spool segment", err, lager.Data{"route": d.name, "segment": segment})
+		}
+	}
+	return true
+}
@@ -0,0 +1,350 @@
+package nozzle
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+const (
+	// maxSyslogMessageLength bounds the octet count accepted for a single frame.
+	maxSyslogMessageLength = 1024 * 1024
+	// maxSyslogLengthDigits is the number of digits of maxSyslogMessageLength,
+	// longer octet counts are rejected before reading any further.
+	maxSyslogLengthDigits = 7
+)
+
+type SyslogConfig struct {
+	ListenAddress string
+	TLSCertFile   string
+	TLSKeyFile    string
+	// connections silent for IdleTimeout are closed, zero keeps them open
+	IdleTimeout time.Duration
+}
+
+type syslogReceiver struct {
+	config   *SyslogConfig
+	logger   lager.Logger
+	listener net.Listener
+	lock     sync.Mutex
+	done     chan struct{}
+}
+
+// NewSyslogReceiver returns a FirehoseClient which, instead of reading the
+// firehose, listens for RFC 5424 syslog drains over TCP or TLS using octet
+// counted framing and turns each drained line into a LogMessage envelope.
+func NewSyslogReceiver(config *SyslogConfig, logger lager.Logger) FirehoseClient {
+	return &syslogReceiver{
+		config: config,
+		logger: logger,
+	}
+}
+
+func (r *syslogReceiver) Connect() (<-chan *events.Envelope, <-chan error) {
+	r.logger.Debug("connect", lager.Data{"syslogListenAddress": r.config.ListenAddress})
+
+	msgChan := make(chan *events.Envelope)
+	errChan := make(chan error, 1)
+
+	listener, err := r.listen()
+	if err != nil {
+		r.logger.Error("error listening for syslog drains", err)
+		errChan <- err
+		return nil, errChan
+	}
+
+	done := make(chan struct{})
+	r.lock.Lock()
+	r.listener = listener
+	r.done = done
+	r.lock.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-done:
+				default:
+					errChan <- err
+				}
+				return
+			}
+			go r.handleConnection(conn, msgChan, done)
+		}
+	}()
+
+	return msgChan, errChan
+}
+
+func (r *syslogReceiver) CloseConsumer() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.listener == nil {
+		return nil
+	}
+	close(r.done)
+	err := r.listener.Close()
+	r.listener = nil
+	return err
+}
+
+func (r *syslogReceiver) listen() (net.Listener, error) {
+	if r.config.TLSCertFile == "" {
+		return net.Listen("tcp", r.config.ListenAddress)
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.TLSCertFile, r.config.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", r.config.ListenAddress, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+}
+
+func (r *syslogReceiver) handleConnection(conn net.Conn, msgChan chan<- *events.Envelope, done <-chan struct{}) {
+	closed := make(chan struct{})
+	defer close(closed)
+	defer conn.Close()
+	go func() {
+		// unblock the reader when the receiver is closed
+		select {
+		case <-done:
+			conn.Close()
+		case <-closed:
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		if r.config.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(r.config.IdleTimeout))
+		}
+
+		frame, err := readOctetCountedFrame(reader)
+		if err != nil {
+			if err != io.EOF {
+				r.logger.Debug("closing syslog connection", lager.Data{"remote": conn.RemoteAddr().String(), "error": err.Error()})
+			}
+			return
+		}
+
+		envelope, err := parseSyslogMessage(frame)
+		if err != nil {
+			r.logger.Error("failed parsing syslog message", err, lager.Data{"remote": conn.RemoteAddr().String()})
+			continue
+		}
+
+		select {
+		case msgChan <- envelope:
+		case <-done:
+			return
+		}
+	}
+}
+
+// readOctetCountedFrame reads a single "MSG-LEN SP SYSLOG-MSG" frame as
+// described in RFC 6587.
+func readOctetCountedFrame(reader *bufio.Reader) ([]byte, error) {
+	length, err := readOctetCount(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length <= 0 || length > maxSyslogMessageLength {
+		return nil, fmt.Errorf("syslog frame length out of range: %d", length)
+	}
+
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// readOctetCount reads the MSG-LEN of a frame up to the space after it. It
+// reads no more than maxSyslogLengthDigits digits, so that a peer which
+// doesn't frame its messages can't make it buffer an endless prefix.
+func readOctetCount(reader *bufio.Reader) (int, error) {
+	length := 0
+	for digits := 0; ; digits++ {
+		c, err := reader.ReadByte()
+		if err != nil {
+			if err == io.EOF && digits > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if c == ' ' && digits > 0 {
+			return length, nil
+		}
+		if c < '0' || c > '9' || digits == maxSyslogLengthDigits {
+			return 0, fmt.Errorf("invalid syslog frame length at byte %q", c)
+		}
+		length = length*10 + int(c-'0')
+	}
+}
+
+// parseSyslogMessage converts an RFC 5424 message emitted by a Cloud Foundry
+// syslog drain into a LogMessage envelope. CF sets APP-NAME to the app GUID
+// and PROCID to "[SOURCE_TYPE/INSTANCE]", which the structured data may
+// override with source_type and instance_id parameters.
+func parseSyslogMessage(msg []byte) (*events.Envelope, error) {
+	s := string(msg)
+
+	if !strings.HasPrefix(s, "<") {
+		return nil, errors.New("missing syslog priority")
+	}
+	end := strings.Index(s, ">")
+	if end < 0 {
+		return nil, errors.New("unterminated syslog priority")
+	}
+	priority, err := strconv.Atoi(s[1:end])
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog priority: %s", s[1:end])
+	}
+	s = s[end+1:]
+
+	// VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	header := make([]string, 6)
+	for i := range header {
+		sp := strings.Index(s, " ")
+		if sp < 0 {
+			return nil, errors.New("truncated syslog header")
+		}
+		header[i], s = s[:sp], s[sp+1:]
+	}
+	if header[0] != "1" {
+		return nil, fmt.Errorf("unsupported syslog version: %s", header[0])
+	}
+
+	params, s, err := parseStructuredData(s)
+	if err != nil {
+		return nil, err
+	}
+	s = strings.TrimPrefix(s, " ")
+	s = strings.TrimPrefix(s, "\ufeff")
+	s = strings.TrimRight(s, "\n")
+
+	var timestamp int64
+	if header[1] != "-" {
+		t, err := time.Parse(time.RFC3339Nano, header[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid syslog timestamp: %s", header[1])
+		}
+		timestamp = t.UnixNano()
+	} else {
+		timestamp = time.Now().UnixNano()
+	}
+
+	sourceType, sourceInstance := splitProcID(header[4])
+	if v, ok := params["source_type"]; ok {
+		sourceType = v
+	}
+	if v, ok := params["instance_id"]; ok {
+		sourceInstance = v
+	}
+
+	messageType := events.LogMessage_OUT
+	if priority&7 <= 3 {
+		messageType = events.LogMessage_ERR
+	}
+
+	tags := params
+	if header[2] != "-" {
+		tags["hostname"] = header[2]
+	}
+
+	logMessage := &events.LogMessage{
+		Message:        []byte(s),
+		MessageType:    &messageType,
+		Timestamp:      proto.Int64(timestamp),
+		SourceType:     proto.String(sourceType),
+		SourceInstance: proto.String(sourceInstance),
+	}
+	if header[3] != "-" {
+		logMessage.AppId = proto.String(header[3])
+	}
+
+	eventType := events.Envelope_LogMessage
+	return &events.Envelope{
+		Origin:     proto.String("syslog"),
+		EventType:  &eventType,
+		Timestamp:  proto.Int64(timestamp),
+		Tags:       tags,
+		LogMessage: logMessage,
+	}, nil
+}
+
+// parseStructuredData returns the parameters of all SD-ELEMENTs at the start
+// of s along with the remainder of the message.
+func parseStructuredData(s string) (map[string]string, string, error) {
+	params := make(map[string]string)
+	if strings.HasPrefix(s, "-") {
+		return params, s[1:], nil
+	}
+
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		// skip the SD-ID
+		for len(s) > 0 && s[0] != ' ' && s[0] != ']' {
+			s = s[1:]
+		}
+		for len(s) > 0 && s[0] == ' ' {
+			s = s[1:]
+			eq := strings.Index(s, "=\"")
+			if eq < 0 {
+				return nil, "", errors.New("invalid structured data parameter")
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+
+			var value []byte
+			for {
+				if len(s) == 0 {
+					return nil, "", errors.New("unterminated structured data value")
+				}
+				c := s[0]
+				s = s[1:]
+				if c == '\\' && len(s) > 0 {
+					value = append(value, s[0])
+					s = s[1:]
+					continue
+				}
+				if c == '"' {
+					break
+				}
+				value = append(value, c)
+			}
+			params[name] = string(value)
+		}
+		if !strings.HasPrefix(s, "]") {
+			return nil, "", errors.New("unterminated structured data element")
+		}
+		s = s[1:]
+	}
+	return params, s, nil
+}
+
+func splitProcID(procID string) (string, string) {
+	procID = strings.TrimSuffix(strings.TrimPrefix(procID, "["), "]")
+	if procID == "-" {
+		return "", ""
+	}
+	i := strings.LastIndex(procID, "/")
+	if i < 0 {
+		return procID, ""
+	}
+	return procID[:i], procID[i+1:]
+}
@@ -0,0 +1,75 @@
+package nozzle_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/humio/cloudfoundry2humio/mocks"
+	"github.com/humio/cloudfoundry2humio/nozzle"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Syslog receiver", func() {
+	var (
+		address  string
+		receiver nozzle.FirehoseClient
+	)
+
+	BeforeEach(func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		address = listener.Addr().String()
+		listener.Close()
+
+		receiver = nozzle.NewSyslogReceiver(&nozzle.SyslogConfig{
+			ListenAddress: address,
+			IdleTimeout:   time.Second,
+		}, mocks.NewMockLogger())
+	})
+
+	AfterEach(func() {
+		receiver.CloseConsumer()
+	})
+
+	It("turns octet counted RFC 5424 messages into log messages", func() {
+		msgChan, _ := receiver.Connect()
+
+		conn, err := net.Dial("tcp", address)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		msg := `<11>1 2017-11-12T10:00:00.123456789Z myorg.myspace.myapp app-guid [APP/PROC/WEB/1] - [tags@47450 app_name="myapp"] something failed` + "\n"
+		fmt.Fprintf(conn, "%d %s", len(msg), msg)
+
+		var envelope *events.Envelope
+		Eventually(msgChan).Should(Receive(&envelope))
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_LogMessage))
+		Expect(envelope.GetTags()).To(HaveKeyWithValue("app_name", "myapp"))
+		Expect(envelope.GetTags()).To(HaveKeyWithValue("hostname", "myorg.myspace.myapp"))
+
+		logMessage := envelope.GetLogMessage()
+		Expect(string(logMessage.GetMessage())).To(Equal("something failed"))
+		Expect(logMessage.GetMessageType()).To(Equal(events.LogMessage_ERR))
+		Expect(logMessage.GetAppId()).To(Equal("app-guid"))
+		Expect(logMessage.GetSourceType()).To(Equal("APP/PROC/WEB"))
+		Expect(logMessage.GetSourceInstance()).To(Equal("1"))
+		Expect(logMessage.GetTimestamp()).To(Equal(int64(1510480800123456789)))
+	})
+	It("closes connections sending an overlong frame length", func() {
+		receiver.Connect()
+
+		conn, err := net.Dial("tcp", address)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		fmt.Fprint(conn, "123456789012345678901234567890")
+
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+	})
+})
@@ -0,0 +1,185 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	segmentSuffix = ".batch"
+	// suffix of segments being written
+	tmpSuffix = ".tmp"
+)
+
+// Spool is an on-disk write-ahead buffer of batches. Every batch is stored in
+// its own segment file, named after a sequence number so that segments are
+// replayed in the order they were written, including across restarts.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	logger   lager.Logger
+	lock     sync.Mutex
+	nextSeq  uint64
+}
+
+// NewSpool opens the spool in dir, creating the directory when needed, and
+// removes the segments a crash left half written. When the segments exceed
+// maxBytes the oldest ones are evicted; a maxBytes of 0 disables the cap.
+func NewSpool(dir string, maxBytes int64, logger lager.Logger) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		logger:   logger,
+	}
+
+	if err := s.removeTmpFiles(); err != nil {
+		return nil, err
+	}
+
+	segments, err := s.Segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		s.nextSeq = segmentSeq(segments[len(segments)-1]) + 1
+		s.logger.Info("found spooled batches to replay", lager.Data{"segments": len(segments)})
+	}
+	return s, nil
+}
+
+// Write stores the payload as a new segment and returns its name.
+func (s *Spool) Write(payload []byte) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	segment := fmt.Sprintf("%020d%s", s.nextSeq, segmentSuffix)
+	s.nextSeq++
+
+	// write to a temporary file first so a crash never leaves a partial
+	// segment behind to be replayed
+	tmp := filepath.Join(s.dir, segment+tmpSuffix)
+	if err := ioutil.WriteFile(tmp, payload, 0600); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, segment)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	s.evict()
+	return segment, nil
+}
+
+// Read returns the payload of a segment.
+func (s *Spool) Read(segment string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(s.dir, segment))
+}
+
+// Remove deletes a segment once its batch has been delivered. Removing a
+// segment which has already been evicted is not an error.
+func (s *Spool) Remove(segment string) error {
+	err := os.Remove(filepath.Join(s.dir, segment))
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Segments lists the segments, oldest first.
+func (s *Spool) Segments() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), segmentSuffix) {
+			segments = append(segments, f.Name())
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// removeTmpFiles deletes the segments which were still being written when
+// the nozzle stopped, they would otherwise never be removed.
+func (s *Spool) removeTmpFiles() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), tmpSuffix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+	}
+	if removed > 0 {
+		s.logger.Info("removed half written spool segments", lager.Data{"files": removed})
+	}
+	return nil
+}
+
+// evict removes the oldest segments until the spool fits its size cap.
+func (s *Spool) evict() {
+	if s.maxBytes <= 0 {
+		return
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		s.logger.Error("failed listing spool segments", err)
+		return
+	}
+
+	var total int64
+	var segments []os.FileInfo
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), segmentSuffix) {
+			segments = append(segments, f)
+			total += f.Size()
+		}
+	}
+
+	// ReadDir sorts by name, which is oldest first
+	evicted := 0
+	for _, f := range segments {
+		if total <= s.maxBytes {
+			break
+		}
+		if err := s.Remove(f.Name()); err != nil {
+			s.logger.Error("failed evicting spool segment", err, lager.Data{"segment": f.Name()})
+			continue
+		}
+		total -= f.Size()
+		evicted++
+	}
+
+	if evicted > 0 {
+		s.logger.Error("spool is full, dropped oldest batches", nil, lager.Data{"segments": evicted})
+	}
+}
+
+func segmentSeq(segment string) uint64 {
+	seq, _ := strconv.ParseUint(strings.TrimSuffix(segment, segmentSuffix), 10, 64)
+	return seq
+}
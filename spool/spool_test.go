@@ -0,0 +1,64 @@
+package spool_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/humio/cloudfoundry2humio/mocks"
+	"github.com/humio/cloudfoundry2humio/spool"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Spool", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "spool")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("keeps segments in order across reopening", func() {
+		s, err := spool.NewSpool(dir, 0, mocks.NewMockLogger())
+		Expect(err).NotTo(HaveOccurred())
+		first, _ := s.Write([]byte("first"))
+		second, _ := s.Write([]byte("second"))
+
+		s, err = spool.NewSpool(dir, 0, mocks.NewMockLogger())
+		Expect(err).NotTo(HaveOccurred())
+		third, _ := s.Write([]byte("third"))
+
+		Expect(s.Segments()).To(Equal([]string{first, second, third}))
+		Expect(s.Read(second)).To(Equal([]byte("second")))
+	})
+
+	It("removes half written segments on open", func() {
+		s, err := spool.NewSpool(dir, 0, mocks.NewMockLogger())
+		Expect(err).NotTo(HaveOccurred())
+		segment, _ := s.Write([]byte("written"))
+		tmp := filepath.Join(dir, "00000000000000000001.batch.tmp")
+		Expect(ioutil.WriteFile(tmp, []byte("half"), 0600)).To(Succeed())
+
+		s, err = spool.NewSpool(dir, 0, mocks.NewMockLogger())
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(tmp).NotTo(BeAnExistingFile())
+		Expect(s.Segments()).To(Equal([]string{segment}))
+	})
+
+	It("evicts the oldest segments beyond the size cap", func() {
+		s, err := spool.NewSpool(dir, 10, mocks.NewMockLogger())
+		Expect(err).NotTo(HaveOccurred())
+		s.Write([]byte("12345"))
+		second, _ := s.Write([]byte("12345"))
+		third, _ := s.Write([]byte("12345"))
+
+		Expect(s.Segments()).To(Equal([]string{second, third}))
+	})
+})